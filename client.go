@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+)
+
+// sendRequest sends the request over the control socket and calls the
+// handler for every data message of the reply. Returns the final message.
+func sendRequest(socketPath string, req *request, handler func(json.RawMessage) error) (*response, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	req.Version = protocolVersion
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(conn)
+	for {
+		resp := &response{}
+		if err := decoder.Decode(resp); err != nil {
+			return nil, err
+		}
+
+		switch resp.Type {
+		case responseData:
+			if handler == nil {
+				continue
+			}
+			if err := handler(resp.Data); err != nil {
+				return nil, err
+			}
+		case responseOk:
+			return resp, nil
+		case responseError:
+			if resp.Error == nil {
+				return nil, errors.New("unknown error")
+			}
+			return nil, resp.Error
+		default:
+			return nil, errors.New("invalid response type: " + resp.Type)
+		}
+	}
+}
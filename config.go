@@ -4,7 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"strings"
+	"time"
 
+	multierror "github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/hcl"
 	"github.com/hashicorp/hcl/hcl/ast"
 )
@@ -12,6 +15,34 @@ import (
 // configKeys is a list of allowed keys in the config
 var configKeys = []string{
 	"job",
+	"history",
+	"shutdown_timeout",
+	"http",
+	"docker_host",
+}
+
+// httpKeys lists all allowed keys inside "http" block
+var httpKeys = []string{
+	"listen",
+	"token",
+}
+
+// historyKeys lists all allowed keys inside "history" block
+var historyKeys = []string{
+	"path",
+	"keep_runs",
+	"max_age",
+}
+
+// notifyKeys lists allowed settings inside "notify" block, registered
+// notifier types are allowed as nested blocks too
+var notifyKeys = []string{
+	"on",
+	"retries",
+	"redact",
+	"message",
+	"after",
+	"realert",
 }
 
 // jobKeys lists all allowed keys inside "job" block
@@ -20,20 +51,53 @@ var jobKeys = []string{
 	"disabled",
 	"spec",
 	"command",
+	"args",
 	"shell",
 	"env",
 	"tz",
 	"dir",
 	"user",
 	"log",
+	"output",
 	"docker",
 	"timeout",
+	"kill_signal",
+	"kill_timeout",
+	"on_exit",
 	"notify",
+	"concurrency",
+	"max_instances",
+	"retry",
+	"on_reload",
+	"expect_success_within",
 }
 
 // Config represents a service configuration
 type Config struct {
-	Jobs []*JobConfig `hcl:"job"`
+	Jobs                  []*JobConfig   `hcl:"job"`
+	History               *HistoryConfig `hcl:"history"`
+	HTTP                  *HTTPConfig    `hcl:"http"`
+	ShutdownTimeoutString string         `hcl:"shutdown_timeout"`
+	DockerHost            string         `hcl:"docker_host"` // Docker daemon address
+
+	// Computed fields
+	ShutdownTimeout time.Duration `hcl:"-"`
+}
+
+// HistoryConfig represents run history settings
+type HistoryConfig struct {
+	Path         string `hcl:"path"`      // Directory to store history in
+	KeepRuns     int    `hcl:"keep_runs"` // Max number of runs per job
+	MaxAgeString string `hcl:"max_age"`   // Max age of the run record
+
+	// Computed fields
+	MaxAge time.Duration `hcl:"-"`
+}
+
+// HTTPConfig represents HTTP API listener settings
+type HTTPConfig struct {
+	Listen string `hcl:"listen"` // Address to listen on
+	Token  string `hcl:"token"`  // Auth token
 }
 
 // readConfig reads and returns a new configuration
@@ -56,43 +120,75 @@ func readConfig(path string) (*Config, error) {
 		return nil, errors.New("file does not containe a root object")
 	}
 
+	// All validation errors are collected and reported at once
+	var result error
+
 	// Validate top level keys
 	if err := checkHCLKeys(list, configKeys); err != nil {
-		return nil, err
+		result = multierror.Append(result, err)
 	}
 
 	config := &Config{}
-	jobNames := map[string]bool{}
 
-	// Load all job definitions
-	if o := list.Filter("job"); len(o.Items) > 0 {
-		for _, item := range o.Items {
-			node := item.Val
+	// Load max time to wait for running jobs on shutdown
+	if o := list.Filter("shutdown_timeout"); len(o.Items) > 0 {
+		node := o.Items[0].Val
 
-			// Validate all keys in the "job" block
-			if err := checkHCLKeys(node, jobKeys); err != nil {
-				return nil, err
-			}
+		if err := hcl.DecodeObject(&config.ShutdownTimeoutString, node); err != nil {
+			result = multierror.Append(result, err)
+		} else if dur, err := time.ParseDuration(config.ShutdownTimeoutString); err != nil {
+			result = multierror.Append(result, fmt.Errorf("error at %s: invalid shutdown_timeout: %v", node.Pos().String(), err))
+		} else {
+			config.ShutdownTimeout = dur
+		}
+	}
 
-			// Parse the job block into config
-			job := new(JobConfig)
-			if err := hcl.DecodeObject(job, node); err != nil {
-				return nil, err
-			}
+	// Load docker daemon address
+	if o := list.Filter("docker_host"); len(o.Items) > 0 {
+		if err := hcl.DecodeObject(&config.DockerHost, o.Items[0].Val); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
 
-			// Try to find the job name from the block definition
-			if job.Name == "" && len(item.Keys) > 0 {
-				job.Name = item.Keys[0].Token.Value().(string)
-			}
+	// Load run history settings
+	if o := list.Filter("history"); len(o.Items) > 0 {
+		if len(o.Items) > 1 {
+			result = multierror.Append(result, fmt.Errorf("error at %s: only one history block is allowed", o.Items[1].Pos().String()))
+		}
+		if history, err := readHistoryConfig(o.Items[0].Val); err != nil {
+			result = multierror.Append(result, err)
+		} else {
+			config.History = history
+		}
+	}
+
+	// Load HTTP listener settings
+	if o := list.Filter("http"); len(o.Items) > 0 {
+		if len(o.Items) > 1 {
+			result = multierror.Append(result, fmt.Errorf("error at %s: only one http block is allowed", o.Items[1].Pos().String()))
+		}
+		if http, err := readHTTPConfig(o.Items[0].Val); err != nil {
+			result = multierror.Append(result, err)
+		} else {
+			config.HTTP = http
+		}
+	}
 
-			// Validate the job config
-			if err := job.validate(); err != nil {
-				return nil, fmt.Errorf("error at %s: %s", node.Pos().String(), err.Error())
+	jobNames := map[string]bool{}
+
+	// Load all job definitions
+	if o := list.Filter("job"); len(o.Items) > 0 {
+		for _, item := range o.Items {
+			job, err := readJobConfig(item)
+			if err != nil {
+				result = multierror.Append(result, err)
+				continue
 			}
 
 			// Check for job duplicates
 			if jobNames[job.Name] {
-				return nil, fmt.Errorf("duplicate job: %s", job.Name)
+				result = multierror.Append(result, fmt.Errorf("error at %s: duplicate job: %s", item.Pos().String(), job.Name))
+				continue
 			}
 			jobNames[job.Name] = true
 
@@ -100,9 +196,221 @@ func readConfig(path string) (*Config, error) {
 		}
 	}
 
+	if result != nil {
+		return nil, result
+	}
 	return config, nil
 }
 
+// readHistoryConfig parses and validates the "history" block
+func readHistoryConfig(node ast.Node) (*HistoryConfig, error) {
+	if err := checkHCLKeys(node, historyKeys); err != nil {
+		return nil, err
+	}
+
+	history := new(HistoryConfig)
+	if err := hcl.DecodeObject(history, node); err != nil {
+		return nil, err
+	}
+	if err := history.validate(); err != nil {
+		return nil, fmt.Errorf("error at %s: %s", node.Pos().String(), err.Error())
+	}
+
+	return history, nil
+}
+
+// readHTTPConfig parses and validates the "http" block
+func readHTTPConfig(node ast.Node) (*HTTPConfig, error) {
+	if err := checkHCLKeys(node, httpKeys); err != nil {
+		return nil, err
+	}
+
+	http := new(HTTPConfig)
+	if err := hcl.DecodeObject(http, node); err != nil {
+		return nil, err
+	}
+	if http.Listen == "" {
+		http.Listen = defaultHTTPListen
+	}
+
+	return http, nil
+}
+
+// readNotifyConfig parses the "notify" block of the job and creates notifiers
+// for all nested target blocks
+func readNotifyConfig(node ast.Node, job *JobConfig) (*NotifyConfig, error) {
+	obj, ok := node.(*ast.ObjectType)
+	if !ok {
+		return nil, fmt.Errorf("error at %s: notify must be a block", node.Pos().String())
+	}
+
+	// Validate settings and target types
+	if err := checkHCLKeys(node, append(notifierKinds(), notifyKeys...)); err != nil {
+		return nil, err
+	}
+
+	// Nested target blocks are skipped by the decoder
+	notify := new(NotifyConfig)
+	if err := hcl.DecodeObject(notify, node); err != nil {
+		return nil, err
+	}
+
+	var result error
+
+	if err := notify.validate(job); err != nil {
+		result = multierror.Append(result, hclFieldError(node, err))
+	}
+
+	// Every block of the registered type is a separate target
+	for _, item := range obj.List.Items {
+		kind := item.Keys[0].Token.Value().(string)
+
+		notifierType, ok := notifierTypes[kind]
+		if !ok {
+			continue
+		}
+		if err := checkHCLKeys(item.Val, notifierType.keys); err != nil {
+			result = multierror.Append(result, err)
+			continue
+		}
+
+		notifier, err := notifierType.create(item.Val, job)
+		if err != nil {
+			if _, ok := err.(*fieldError); !ok {
+				err = fmt.Errorf("invalid %s: %v", kind, err)
+			}
+			result = multierror.Append(result, hclFieldError(item.Val, err))
+			continue
+		}
+		notify.Notifiers = append(notify.Notifiers, notifier)
+	}
+
+	if result != nil {
+		return nil, result
+	}
+	return notify, nil
+}
+
+// readJobConfig parses and validates the "job" block
+func readJobConfig(item *ast.ObjectItem) (*JobConfig, error) {
+	node := item.Val
+
+	// Validate all keys in the "job" block
+	if err := checkHCLKeys(node, jobKeys); err != nil {
+		return nil, err
+	}
+
+	// Parse the job block into config
+	job := new(JobConfig)
+	if err := hcl.DecodeObject(job, node); err != nil {
+		return nil, err
+	}
+
+	// Try to find the job name from the block definition
+	if job.Name == "" && len(item.Keys) > 0 {
+		job.Name = item.Keys[0].Token.Value().(string)
+	}
+
+	// Validate the job config
+	if err := job.validate(); err != nil {
+		return nil, hclFieldError(node, err)
+	}
+
+	// Parse notification settings and targets, templates are checked
+	// against the validated job config
+	if o := node.(*ast.ObjectType).List.Filter("notify"); len(o.Items) > 0 {
+		if len(o.Items) > 1 {
+			return nil, fmt.Errorf("error at %s: only one notify block is allowed", o.Items[1].Pos().String())
+		}
+		notify, err := readNotifyConfig(o.Items[0].Val, job)
+		if err != nil {
+			return nil, err
+		}
+		job.Notify = notify
+	}
+
+	return job, nil
+}
+
+// validate performs validation on history attributes
+func (h *HistoryConfig) validate() error {
+	if h.KeepRuns < 0 {
+		return errors.New("keep_runs must not be negative")
+	}
+
+	if val := h.MaxAgeString; val != "" {
+		dur, err := time.ParseDuration(val)
+		if err != nil {
+			return fmt.Errorf("invalid max_age: %v", err)
+		}
+		h.MaxAge = dur
+	}
+
+	return nil
+}
+
+// configDiff represents changes between two configurations
+type configDiff struct {
+	Added     []string `json:"added"`
+	Removed   []string `json:"removed"`
+	Changed   []string `json:"changed"`
+	Unchanged []string `json:"unchanged"`
+}
+
+// diffConfigs compares jobs of two configurations by name and content
+func diffConfigs(old *Config, new *Config) *configDiff {
+	diff := &configDiff{}
+
+	for _, job := range new.Jobs {
+		prev := old.findJob(job.Name)
+		switch {
+		case prev == nil:
+			diff.Added = append(diff.Added, job.Name)
+		case prev.checksum() != job.checksum():
+			diff.Changed = append(diff.Changed, job.Name)
+		default:
+			diff.Unchanged = append(diff.Unchanged, job.Name)
+		}
+	}
+
+	for _, job := range old.Jobs {
+		if new.findJob(job.Name) == nil {
+			diff.Removed = append(diff.Removed, job.Name)
+		}
+	}
+
+	return diff
+}
+
+// isUnchanged returns true if the job is the same in both configurations
+func (d *configDiff) isUnchanged(name string) bool {
+	for _, n := range d.Unchanged {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns a summary of the changes
+func (d *configDiff) String() string {
+	if len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0 {
+		return "no changes"
+	}
+
+	parts := []string{}
+	if len(d.Added) > 0 {
+		parts = append(parts, "added: "+strings.Join(d.Added, ", "))
+	}
+	if len(d.Removed) > 0 {
+		parts = append(parts, "removed: "+strings.Join(d.Removed, ", "))
+	}
+	if len(d.Changed) > 0 {
+		parts = append(parts, "changed: "+strings.Join(d.Changed, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
 // findJob returns a job config that matches given name
 func (c *Config) findJob(name string) *JobConfig {
 	for _, j := range c.Jobs {
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// Time to wait for the container to exit before it is killed
+	dockerStopTimeout = 10 * time.Second
+
+	// Labels set on every container started by cron2
+	dockerJobLabel = "cron2.job"
+	dockerRunLabel = "cron2.run"
+)
+
+// containerNamePattern matches characters not allowed in container names
+var containerNamePattern = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// containerName returns a unique container name of the job run
+func containerName(j *Job) string {
+	name := containerNamePattern.ReplaceAllString(j.config.Name, "-")
+	return fmt.Sprintf("cron2-%s-%d", strings.Trim(name, "-."), j.id)
+}
+
+// dockerRunArgs returns "docker run" arguments for the job run
+func dockerRunArgs(j *Job, name string) []string {
+	config := j.config.Docker
+
+	args := []string{
+		"run",
+		"--rm", // remove container after execution
+		"--name", name,
+		"--label", dockerJobLabel + "=" + j.config.Name,
+		"--label", dockerRunLabel + "=" + strconv.FormatInt(j.id, 10),
+		"--pull", config.Pull,
+	}
+
+	// Shell reads the command from stdin
+	if j.config.Shell != "" {
+		args = append(args, "-i")
+	}
+
+	// Working directory inside container
+	if j.config.Dir != "" {
+		args = append(args, "--workdir", j.config.Dir)
+	}
+
+	user := config.User
+	if user == "" {
+		user = j.config.User
+	}
+	if user != "" {
+		args = append(args, "--user", user)
+	}
+
+	if config.Entrypoint != "" {
+		args = append(args, "--entrypoint", config.Entrypoint)
+	}
+	if config.Network != "" {
+		args = append(args, "--network", config.Network)
+	}
+	if config.Memory != "" {
+		args = append(args, "--memory", config.Memory)
+	}
+	if config.CPUs > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(config.CPUs, 'f', -1, 64))
+	}
+	for _, volume := range config.Volumes {
+		args = append(args, "--volume", volume)
+	}
+
+	// Sort labels and env vars to keep the command stable
+	for _, key := range sortedKeys(config.Labels) {
+		args = append(args, "--label", key+"="+config.Labels[key])
+	}
+	if config.EnvFile != "" {
+		args = append(args, "--env-file", config.EnvFile)
+	}
+	for _, key := range sortedKeys(j.config.Environment) {
+		args = append(args, "--env", key+"="+j.config.Environment[key])
+	}
+
+	args = append(args, config.Image)
+	if j.config.Shell != "" {
+		args = append(args, j.config.Shell)
+	} else {
+		args = append(args, j.config.Argv...)
+	}
+
+	return args
+}
+
+// stopContainer stops and removes the container of the job run
+func stopContainer(j *Job, name string) {
+	log.Printf("[%s] stopping container %s\n", j.config.Name, name)
+
+	timeout := strconv.Itoa(int(dockerStopTimeout.Seconds()))
+	if out, err := exec.Command("docker", "stop", "--time", timeout, name).CombinedOutput(); err != nil {
+		log.Printf("[%s] cant stop container %s: %v: %s\n", j.config.Name, name, err, strings.TrimSpace(string(out)))
+	}
+
+	// Container is removed by --rm, unless it did not exit in time
+	if out, err := exec.Command("docker", "rm", "--force", name).CombinedOutput(); err != nil && !strings.Contains(string(out), "No such container") && !strings.Contains(string(out), "already in progress") {
+		log.Printf("[%s] cant remove container %s: %v: %s\n", j.config.Name, name, err, strings.TrimSpace(string(out)))
+	}
+}
+
+// sortedKeys returns keys of the map in alphabetical order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// runDockerAPI executes the job in a docker container through the docker API
+func runDockerAPI(j *Job) {
+	ctx, cancel := j.runContext()
+	defer cancel()
+
+	j.success = false
+	j.exitStatus = 1
+
+	client, err := j.service.dockerAPI()
+	if err != nil {
+		log.Printf("[%s] cant connect to docker: %v\n", j.config.Name, err)
+		return
+	}
+
+	name := containerName(j)
+
+	config, err := dockerContainerSpec(j)
+	if err != nil {
+		log.Printf("[%s] cant prepare container: %v\n", j.config.Name, err)
+		return
+	}
+
+	out, err := j.openOutput()
+	if err != nil {
+		return
+	}
+	defer out.Close()
+
+	id, err := createContainer(ctx, client, name, config, j.config.Docker.Pull)
+	if err != nil {
+		log.Printf("[%s] cant create container: %v\n", j.config.Name, err)
+		return
+	}
+	log.Printf("[%s] created container %s\n", j.config.Name, name)
+
+	// Container is removed after the run, even when the run is cancelled
+	defer func() {
+		rctx, cancel := context.WithTimeout(context.Background(), dockerRequestTimeout)
+		defer cancel()
+		if err := client.removeContainer(rctx, id); err != nil {
+			log.Printf("[%s] cant remove container %s: %v\n", j.config.Name, name, err)
+		}
+	}()
+
+	if err := client.startContainer(ctx, id); err != nil {
+		log.Printf("[%s] cant start container: %v\n", j.config.Name, err)
+		return
+	}
+
+	// Allow the service to signal the container on shutdown
+	j.service.state.setKill(j, func(sig syscall.Signal) error {
+		kctx, cancel := context.WithTimeout(context.Background(), dockerRequestTimeout)
+		defer cancel()
+		return client.killContainer(kctx, id, strconv.Itoa(int(sig)))
+	})
+	defer j.service.state.setKill(j, nil)
+
+	// Logs and wait requests end when the container exits
+	logsDone := make(chan error, 1)
+	go func() {
+		logsDone <- client.containerLogs(context.Background(), id, out.stdout, out.stderr)
+	}()
+
+	type waitResult struct {
+		code int
+		err  error
+	}
+	waitDone := make(chan waitResult, 1)
+	go func() {
+		code, err := client.waitContainer(context.Background(), id)
+		waitDone <- waitResult{code, err}
+	}()
+
+	var result waitResult
+	select {
+	case result = <-waitDone:
+	case <-ctx.Done():
+		log.Printf("[%s] stopping container %s\n", j.config.Name, name)
+
+		sctx, cancel := context.WithTimeout(context.Background(), dockerStopTimeout+dockerRequestTimeout)
+		if err := client.stopContainer(sctx, id, dockerStopTimeout); err != nil {
+			log.Printf("[%s] cant stop container %s: %v\n", j.config.Name, name, err)
+		}
+		cancel()
+
+		result = <-waitDone
+	}
+
+	if err := <-logsDone; err != nil {
+		log.Printf("[%s] cant read container logs: %v\n", j.config.Name, err)
+	}
+
+	if result.err != nil {
+		j.finish(ctx, 1, result.err)
+		return
+	}
+	j.finish(ctx, result.code, nil)
+
+	ictx, cancel := context.WithTimeout(context.Background(), dockerRequestTimeout)
+	defer cancel()
+	if state, err := client.inspectContainer(ictx, id); err != nil {
+		log.Printf("[%s] cant inspect container: %v\n", j.config.Name, err)
+	} else if state.OOMKilled {
+		j.oomKilled = true
+		j.success = false
+		log.Printf("[%s] container was killed: out of memory\n", j.config.Name)
+	}
+}
+
+// createContainer creates the container, pulling the image according to the
+// pull policy
+func createContainer(ctx context.Context, client *dockerClient, name string, config *dockerContainerConfig, pull string) (string, error) {
+	if pull == dockerPullAlways {
+		if err := client.pullImage(ctx, config.Image); err != nil {
+			return "", fmt.Errorf("cant pull image: %v", err)
+		}
+	}
+
+	id, err := client.createContainer(ctx, name, config)
+	if err == errNoSuchImage && pull == dockerPullMissing {
+		if err := client.pullImage(ctx, config.Image); err != nil {
+			return "", fmt.Errorf("cant pull image: %v", err)
+		}
+		id, err = client.createContainer(ctx, name, config)
+	}
+	return id, err
+}
+
+// dockerContainerSpec returns the container create request of the job run
+func dockerContainerSpec(j *Job) (*dockerContainerConfig, error) {
+	config := j.config.Docker
+
+	spec := &dockerContainerConfig{
+		Image:      config.Image,
+		WorkingDir: j.config.Dir,
+		User:       config.User,
+		Labels: map[string]string{
+			dockerJobLabel: j.config.Name,
+			dockerRunLabel: strconv.FormatInt(j.id, 10),
+		},
+		HostConfig: dockerHostConfig{
+			Binds:       config.Volumes,
+			NetworkMode: config.Network,
+			Memory:      config.memoryBytes(),
+			NanoCPUs:    int64(config.CPUs * 1e9),
+		},
+	}
+	if spec.User == "" {
+		spec.User = j.config.User
+	}
+	if config.Entrypoint != "" {
+		spec.Entrypoint = []string{config.Entrypoint}
+	}
+	for key, val := range config.Labels {
+		spec.Labels[key] = val
+	}
+
+	env, err := dockerEnv(j)
+	if err != nil {
+		return nil, err
+	}
+	spec.Env = env
+	spec.Cmd = dockerCommand(j)
+
+	return spec, nil
+}
+
+// dockerEnv returns env vars of the job. Job env vars take precedence over
+// the env file.
+func dockerEnv(j *Job) ([]string, error) {
+	var env []string
+
+	if file := j.config.Docker.EnvFile; file != "" {
+		vars, err := readEnvFile(file)
+		if err != nil {
+			return nil, err
+		}
+		env = vars
+	}
+	for _, key := range sortedKeys(j.config.Environment) {
+		env = append(env, key+"="+j.config.Environment[key])
+	}
+
+	return env, nil
+}
+
+// dockerCommand returns the command to run in the container
+func dockerCommand(j *Job) []string {
+	if j.config.Shell != "" {
+		return []string{j.config.Shell, "-c", strings.TrimSpace(j.config.Command)}
+	}
+	return j.config.Argv
+}
+
+// readEnvFile reads env vars in docker env file format. Lines without value
+// take it from the service environment.
+func readEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	env := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.Contains(line, "=") {
+			val, ok := os.LookupEnv(line)
+			if !ok {
+				continue
+			}
+			line += "=" + val
+		}
+		env = append(env, line)
+	}
+
+	return env, scanner.Err()
+}
+
+// dockerAPI returns the docker API client. The client is created on first
+// use, the daemon address is only required by jobs using the API.
+func (s *Service) dockerAPI() (*dockerClient, error) {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	if s.docker == nil {
+		client, err := newDockerClient(s.config.DockerHost)
+		if err != nil {
+			return nil, err
+		}
+		s.docker = client
+	}
+	return s.docker, nil
+}
+
+// removeOrphanContainers removes containers left by the previous service
+// run, e.g. after a crash. Only used when jobs run through the docker API.
+func (s *Service) removeOrphanContainers() {
+	s.configLock.Lock()
+	used := false
+	for _, job := range s.config.Jobs {
+		if job.Docker != nil && job.Docker.Executor == dockerExecutorAPI {
+			used = true
+		}
+	}
+	s.configLock.Unlock()
+
+	if !used {
+		return
+	}
+
+	client, err := s.dockerAPI()
+	if err != nil {
+		log.Println("cant check orphaned containers:", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dockerRequestTimeout)
+	defer cancel()
+
+	containers, err := client.listContainers(ctx, dockerJobLabel)
+	if err != nil {
+		log.Println("cant list orphaned containers:", err)
+		return
+	}
+
+	for _, c := range containers {
+		log.Printf("removing orphaned container %s of job %q\n", strings.Join(c.Names, ", "), c.Labels[dockerJobLabel])
+		if err := client.removeContainer(ctx, c.ID); err != nil {
+			log.Printf("cant remove container %s: %v\n", c.ID, err)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Default address of the docker daemon
+	defaultDockerHost = "unix:///var/run/docker.sock"
+
+	// Max time of docker API calls, except for streaming ones
+	dockerRequestTimeout = 30 * time.Second
+)
+
+// errNoSuchImage is returned when the container image is not pulled
+var errNoSuchImage = errors.New("no such image")
+
+// dockerClient talks to the Docker Engine API
+type dockerClient struct {
+	http *http.Client
+	base string
+}
+
+// dockerError represents an error response of the docker API
+type dockerError struct {
+	Status  int
+	Message string `json:"message"`
+}
+
+func (e *dockerError) Error() string {
+	return fmt.Sprintf("docker api error %d: %s", e.Status, e.Message)
+}
+
+// newDockerClient returns a client for the given daemon address, either
+// "unix:///path/to/socket" or "tcp://host:port"
+func newDockerClient(host string) (*dockerClient, error) {
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		host = defaultDockerHost
+	}
+
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &dockerClient{base: "http://docker"}
+	transport := &http.Transport{}
+
+	switch u.Scheme {
+	case "unix":
+		dialer := &net.Dialer{Timeout: dockerRequestTimeout}
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", u.Path)
+		}
+	case "tcp", "http":
+		client.base = "http://" + u.Host
+	default:
+		return nil, fmt.Errorf("unsupported docker host: %s", host)
+	}
+
+	client.http = &http.Client{Transport: transport}
+	return client, nil
+}
+
+// do performs the API request and decodes the JSON response into out
+func (c *dockerClient) do(ctx context.Context, method string, path string, query url.Values, in interface{}, out interface{}) error {
+	resp, err := c.request(ctx, method, path, query, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// request performs the API request and returns the response with a successful
+// status, the caller must close the body
+func (c *dockerClient) request(ctx context.Context, method string, path string, query url.Values, in interface{}) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	u := c.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+
+		apiErr := &dockerError{Status: resp.StatusCode}
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if json.Unmarshal(data, apiErr) != nil || apiErr.Message == "" {
+			apiErr.Message = strings.TrimSpace(string(data))
+		}
+		return nil, apiErr
+	}
+
+	return resp, nil
+}
+
+// dockerContainerConfig represents the container create request
+type dockerContainerConfig struct {
+	Image      string            `json:"Image"`
+	Cmd        []string          `json:"Cmd,omitempty"`
+	Entrypoint []string          `json:"Entrypoint,omitempty"`
+	Env        []string          `json:"Env,omitempty"`
+	WorkingDir string            `json:"WorkingDir,omitempty"`
+	User       string            `json:"User,omitempty"`
+	Labels     map[string]string `json:"Labels,omitempty"`
+	HostConfig dockerHostConfig  `json:"HostConfig"`
+}
+
+// dockerHostConfig represents host settings of the container
+type dockerHostConfig struct {
+	Binds       []string `json:"Binds,omitempty"`
+	NetworkMode string   `json:"NetworkMode,omitempty"`
+	Memory      int64    `json:"Memory,omitempty"`
+	NanoCPUs    int64    `json:"NanoCpus,omitempty"`
+}
+
+// dockerContainer represents the container summary in the list
+type dockerContainer struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	State  string            `json:"State"`
+	Labels map[string]string `json:"Labels"`
+}
+
+// dockerContainerState represents the container state in inspect response
+type dockerContainerState struct {
+	Status    string `json:"Status"`
+	Running   bool   `json:"Running"`
+	OOMKilled bool   `json:"OOMKilled"`
+	ExitCode  int    `json:"ExitCode"`
+}
+
+// createContainer creates the container and returns its ID
+func (c *dockerClient) createContainer(ctx context.Context, name string, config *dockerContainerConfig) (string, error) {
+	result := struct {
+		ID string `json:"Id"`
+	}{}
+
+	err := c.do(ctx, http.MethodPost, "/containers/create", url.Values{"name": {name}}, config, &result)
+	if apiErr, ok := err.(*dockerError); ok && apiErr.Status == http.StatusNotFound {
+		return "", errNoSuchImage
+	}
+	return result.ID, err
+}
+
+// pullImage pulls the image from the registry
+func (c *dockerClient) pullImage(ctx context.Context, image string) error {
+	name, tag := splitImageTag(image)
+
+	resp, err := c.request(ctx, http.MethodPost, "/images/create", url.Values{"fromImage": {name}, "tag": {tag}}, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Pull errors are reported in the progress stream
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		msg := struct {
+			Error string `json:"error"`
+		}{}
+		if json.Unmarshal(scanner.Bytes(), &msg) == nil && msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+	}
+	return scanner.Err()
+}
+
+// startContainer starts the created container
+func (c *dockerClient) startContainer(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodPost, "/containers/"+id+"/start", nil, nil, nil)
+}
+
+// waitContainer waits for the container to exit and returns its exit code
+func (c *dockerClient) waitContainer(ctx context.Context, id string) (int, error) {
+	result := struct {
+		StatusCode int `json:"StatusCode"`
+		Error      *struct {
+			Message string `json:"Message"`
+		} `json:"Error"`
+	}{}
+
+	if err := c.do(ctx, http.MethodPost, "/containers/"+id+"/wait", nil, nil, &result); err != nil {
+		return 0, err
+	}
+	if result.Error != nil && result.Error.Message != "" {
+		return result.StatusCode, errors.New(result.Error.Message)
+	}
+	return result.StatusCode, nil
+}
+
+// inspectContainer returns the container state, id could be the container name
+func (c *dockerClient) inspectContainer(ctx context.Context, id string) (*dockerContainerState, error) {
+	result := struct {
+		State *dockerContainerState `json:"State"`
+	}{}
+
+	if err := c.do(ctx, http.MethodGet, "/containers/"+id+"/json", nil, nil, &result); err != nil {
+		return nil, err
+	}
+	if result.State == nil {
+		return nil, errors.New("container state is missing")
+	}
+	return result.State, nil
+}
+
+// containerLogs streams stdout and stderr of the container until it exits
+func (c *dockerClient) containerLogs(ctx context.Context, id string, stdout io.Writer, stderr io.Writer) error {
+	query := url.Values{"follow": {"1"}, "stdout": {"1"}, "stderr": {"1"}}
+
+	resp, err := c.request(ctx, http.MethodGet, "/containers/"+id+"/logs", query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return demuxDockerStream(resp.Body, stdout, stderr)
+}
+
+// stopContainer sends SIGTERM to the container and kills it after the timeout
+func (c *dockerClient) stopContainer(ctx context.Context, id string, timeout time.Duration) error {
+	query := url.Values{"t": {strconv.Itoa(int(timeout.Seconds()))}}
+	return c.do(ctx, http.MethodPost, "/containers/"+id+"/stop", query, nil, nil)
+}
+
+// killContainer sends the signal to the container
+func (c *dockerClient) killContainer(ctx context.Context, id string, signal string) error {
+	return c.do(ctx, http.MethodPost, "/containers/"+id+"/kill", url.Values{"signal": {signal}}, nil, nil)
+}
+
+// removeContainer removes the container with its anonymous volumes
+func (c *dockerClient) removeContainer(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/containers/"+id, url.Values{"force": {"1"}, "v": {"1"}}, nil, nil)
+}
+
+// listContainers returns all containers with the given label
+func (c *dockerClient) listContainers(ctx context.Context, label string) ([]*dockerContainer, error) {
+	filters, err := json.Marshal(map[string][]string{"label": {label}})
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*dockerContainer{}
+	err = c.do(ctx, http.MethodGet, "/containers/json", url.Values{"all": {"1"}, "filters": {string(filters)}}, nil, &result)
+	return result, err
+}
+
+// dockerExecConfig represents the exec create request
+type dockerExecConfig struct {
+	Cmd          []string `json:"Cmd"`
+	Env          []string `json:"Env,omitempty"`
+	WorkingDir   string   `json:"WorkingDir,omitempty"`
+	User         string   `json:"User,omitempty"`
+	AttachStdout bool     `json:"AttachStdout"`
+	AttachStderr bool     `json:"AttachStderr"`
+}
+
+// dockerExecState represents the exec inspect response
+type dockerExecState struct {
+	Running  bool `json:"Running"`
+	ExitCode int  `json:"ExitCode"`
+}
+
+// createExec creates the command to run in the container and returns its ID
+func (c *dockerClient) createExec(ctx context.Context, container string, config *dockerExecConfig) (string, error) {
+	result := struct {
+		ID string `json:"Id"`
+	}{}
+
+	err := c.do(ctx, http.MethodPost, "/containers/"+container+"/exec", nil, config, &result)
+	return result.ID, err
+}
+
+// startExec runs the command and streams its output until it exits
+func (c *dockerClient) startExec(ctx context.Context, id string, stdout io.Writer, stderr io.Writer) error {
+	body := map[string]bool{"Detach": false, "Tty": false}
+
+	resp, err := c.request(ctx, http.MethodPost, "/exec/"+id+"/start", nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return demuxDockerStream(resp.Body, stdout, stderr)
+}
+
+// inspectExec returns the state of the command
+func (c *dockerClient) inspectExec(ctx context.Context, id string) (*dockerExecState, error) {
+	result := &dockerExecState{}
+	err := c.do(ctx, http.MethodGet, "/exec/"+id+"/json", nil, nil, result)
+	return result, err
+}
+
+// demuxDockerStream splits the multiplexed log stream into stdout and stderr.
+// Every frame starts with an 8 byte header: stream type, 3 zero bytes and the
+// big endian payload size.
+func demuxDockerStream(r io.Reader, stdout io.Writer, stderr io.Writer) error {
+	header := make([]byte, 8)
+
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		w := stdout
+		if header[0] == 2 {
+			w = stderr
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(w, r, size); err != nil {
+			return err
+		}
+	}
+}
+
+// splitImageTag returns the image name and tag, "latest" when not set
+func splitImageTag(image string) (string, string) {
+	if strings.Contains(image, "@") {
+		return image, ""
+	}
+
+	// Colon before the last slash belongs to the registry port
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i], image[i+1:]
+	}
+	return image, "latest"
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDocker is the docker API server with a single container that exits
+// as soon as it is started
+type fakeDocker struct {
+	lock      sync.Mutex
+	images    map[string]bool
+	requests  []string
+	created   *dockerContainerConfig
+	exitCode  int
+	oomKilled bool
+	removed   bool
+}
+
+func (d *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.requests = append(d.requests, r.Method+" "+r.URL.Path)
+	reply := func(status int, body interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	}
+
+	switch r.Method + " " + r.URL.Path {
+	case "POST /containers/create":
+		config := &dockerContainerConfig{}
+		if err := json.NewDecoder(r.Body).Decode(config); err != nil {
+			reply(http.StatusBadRequest, map[string]string{"message": err.Error()})
+			return
+		}
+		image := config.Image
+		if !strings.Contains(image, ":") {
+			image += ":latest"
+		}
+		if !d.images[image] {
+			reply(http.StatusNotFound, map[string]string{"message": "No such image: " + image})
+			return
+		}
+		d.created = config
+		reply(http.StatusCreated, map[string]string{"Id": "c1"})
+	case "POST /images/create":
+		d.images[r.URL.Query().Get("fromImage")+":"+r.URL.Query().Get("tag")] = true
+		w.Write([]byte(`{"status":"Pulling fs layer"}` + "\n" + `{"status":"Download complete"}` + "\n"))
+	case "POST /containers/c1/start":
+		w.WriteHeader(http.StatusNoContent)
+	case "POST /containers/c1/wait":
+		reply(http.StatusOK, map[string]int{"StatusCode": d.exitCode})
+	case "GET /containers/c1/logs":
+		w.Write(dockerFrame(1, "hello\n"))
+		w.Write(dockerFrame(2, "oops\n"))
+	case "GET /containers/c1/json":
+		reply(http.StatusOK, map[string]*dockerContainerState{"State": {
+			Status:    "exited",
+			OOMKilled: d.oomKilled,
+			ExitCode:  d.exitCode,
+		}})
+	case "DELETE /containers/c1":
+		d.removed = true
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		reply(http.StatusNotFound, map[string]string{"message": "page not found"})
+	}
+}
+
+// startFakeDocker starts the fake docker API server on a unix socket, and
+// returns the func to stop it
+func startFakeDocker(t *testing.T, images ...string) (*fakeDocker, *dockerClient, func()) {
+	dir, err := ioutil.TempDir("", "cron2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	docker := &fakeDocker{images: map[string]bool{}}
+	for _, image := range images {
+		docker.images[image] = true
+	}
+
+	server := httptest.NewUnstartedServer(docker)
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+
+	cleanup := func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+
+	client, err := newDockerClient("unix://" + path)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return docker, client, cleanup
+}
+
+// dockerFrame returns the frame of the multiplexed docker stream
+func dockerFrame(stream byte, payload string) []byte {
+	frame := make([]byte, 8, 8+len(payload))
+	frame[0] = stream
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+// newTestDockerJob returns the job run through the docker API
+func newTestDockerJob(t *testing.T, client *dockerClient, config *DockerConfig) *Job {
+	config.Executor = dockerExecutorAPI
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &Job{
+		config: &JobConfig{
+			Name:    "etl",
+			Command: "echo hello",
+			Argv:    []string{"echo", "hello"},
+			Docker:  config,
+		},
+		service:  &Service{configLock: new(sync.Mutex), docker: client, state: newStateRegistry()},
+		id:       5,
+		ctx:      context.Background(),
+		instance: &runInstance{},
+		output:   newTailBuffer(tailBufferSize),
+	}
+}
+
+func TestDockerAPIRun(t *testing.T) {
+	docker, client, cleanup := startFakeDocker(t)
+	defer cleanup()
+	j := newTestDockerJob(t, client, &DockerConfig{Image: "busybox"})
+
+	runDockerAPI(j)
+
+	if !j.success || j.exitStatus != 0 {
+		t.Fatalf("run failed with %d", j.exitStatus)
+	}
+	if out := j.output.tail(10, 1024); out != "hello\noops" {
+		t.Errorf("output = %q", out)
+	}
+
+	// Missing image is pulled and the container is created again
+	expected := []string{
+		"POST /containers/create",
+		"POST /images/create",
+		"POST /containers/create",
+		"POST /containers/c1/start",
+	}
+	requests := strings.Join(docker.requests, ", ")
+	if !strings.HasPrefix(requests, strings.Join(expected, ", ")) {
+		t.Errorf("requests = %s", requests)
+	}
+	for _, req := range []string{"POST /containers/c1/wait", "GET /containers/c1/logs", "GET /containers/c1/json"} {
+		if !strings.Contains(requests, req) {
+			t.Errorf("request %s is missing: %s", req, requests)
+		}
+	}
+	if !docker.removed || docker.requests[len(docker.requests)-1] != "DELETE /containers/c1" {
+		t.Errorf("container is not removed: %s", requests)
+	}
+
+	if docker.created.Labels[dockerJobLabel] != "etl" || docker.created.Labels[dockerRunLabel] != "5" {
+		t.Errorf("labels = %v", docker.created.Labels)
+	}
+	if cmd := strings.Join(docker.created.Cmd, " "); cmd != "echo hello" {
+		t.Errorf("cmd = %q", cmd)
+	}
+}
+
+func TestDockerAPIRunOOM(t *testing.T) {
+	docker, client, cleanup := startFakeDocker(t, "busybox:latest")
+	defer cleanup()
+	docker.exitCode = 137
+	docker.oomKilled = true
+
+	j := newTestDockerJob(t, client, &DockerConfig{Image: "busybox"})
+	runDockerAPI(j)
+
+	if j.success || j.exitStatus != 137 || !j.oomKilled {
+		t.Errorf("success = %v, exit status = %d, oom killed = %v", j.success, j.exitStatus, j.oomKilled)
+	}
+	for _, req := range docker.requests {
+		if req == "POST /images/create" {
+			t.Error("existing image is pulled")
+		}
+	}
+	if !docker.removed {
+		t.Error("container is not removed")
+	}
+}
+
+func TestDockerAPIRunPullNever(t *testing.T) {
+	docker, client, cleanup := startFakeDocker(t)
+	defer cleanup()
+	j := newTestDockerJob(t, client, &DockerConfig{Image: "busybox", Pull: dockerPullNever})
+
+	runDockerAPI(j)
+
+	if j.success || j.exitStatus != 1 {
+		t.Errorf("success = %v, exit status = %d", j.success, j.exitStatus)
+	}
+	if requests := strings.Join(docker.requests, ", "); requests != "POST /containers/create" {
+		t.Errorf("requests = %s", requests)
+	}
+}
+
+func TestDemuxDockerStream(t *testing.T) {
+	large := strings.Repeat("x", 70000)
+
+	stream := &bytes.Buffer{}
+	stream.Write(dockerFrame(1, "out 1\n"))
+	stream.Write(dockerFrame(2, "err 1\n"))
+	stream.Write(dockerFrame(1, ""))
+	stream.Write(dockerFrame(1, large))
+	stream.Write(dockerFrame(2, "err 2\n"))
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	if err := demuxDockerStream(stream, stdout, stderr); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "out 1\n"+large {
+		t.Errorf("stdout has %d bytes", stdout.Len())
+	}
+	if stderr.String() != "err 1\nerr 2\n" {
+		t.Errorf("stderr = %q", stderr)
+	}
+
+	// Stream ends in the middle of a frame
+	truncated := dockerFrame(1, "hello")
+	for _, data := range [][]byte{truncated[:4], truncated[:10]} {
+		err := demuxDockerStream(bytes.NewReader(data), ioutil.Discard, ioutil.Discard)
+		if err == nil {
+			t.Errorf("expected error for %d bytes of the frame", len(data))
+		}
+	}
+}
+
+func TestSplitImageTag(t *testing.T) {
+	examples := []struct {
+		image string
+		name  string
+		tag   string
+	}{
+		{"busybox", "busybox", "latest"},
+		{"alpine:3.18", "alpine", "3.18"},
+		{"library/ubuntu:22.04", "library/ubuntu", "22.04"},
+		{"registry.local:5000/app", "registry.local:5000/app", "latest"},
+		{"registry.local:5000/app:v1", "registry.local:5000/app", "v1"},
+		{"app@sha256:abcd", "app@sha256:abcd", ""},
+	}
+
+	for _, ex := range examples {
+		name, tag := splitImageTag(ex.image)
+		if name != ex.name || tag != ex.tag {
+			t.Errorf("splitImageTag(%q) = %q, %q, expected %q, %q", ex.image, name, tag, ex.name, ex.tag)
+		}
+	}
+}
+
+func TestDockerAPIError(t *testing.T) {
+	_, client, cleanup := startFakeDocker(t)
+	defer cleanup()
+
+	_, err := client.inspectContainer(context.Background(), "missing")
+	apiErr, ok := err.(*dockerError)
+	if !ok || apiErr.Status != http.StatusNotFound || apiErr.Message != "page not found" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err.Error() != fmt.Sprintf("docker api error %d: page not found", http.StatusNotFound) {
+		t.Errorf("error = %q", err)
+	}
+}
+
+func TestDockerAPIInvalidHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cron2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Service without API jobs does not need the daemon address
+	config := &Config{DockerHost: "ssh://deploy@docker-host", History: &HistoryConfig{Path: dir}}
+	service, err := newService(config, "")
+	if err != nil {
+		t.Fatalf("service is not created: %v", err)
+	}
+	service.removeOrphanContainers()
+
+	if _, err := service.dockerAPI(); err == nil || err.Error() != "unsupported docker host: ssh://deploy@docker-host" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Scripts run with sh inside the container. Docker API can't signal exec'd
+// commands, so the command records its PID in a file and is signalled by
+// another exec. Exec'd commands are session leaders, the whole process
+// group is signalled unless the PID is not the group ID.
+const (
+	// Arguments: PID file, command
+	dockerExecWrapper = `f=$1; shift; echo $$ > "$f"; "$@"; code=$?; rm -f "$f"; exit $code`
+
+	// Arguments: PID file, signal number
+	dockerExecKill = `f=$1; sig=$2
+pid=$(cat "$f" 2>/dev/null) || exit 0
+[ "$sig" = 9 ] && rm -f "$f"
+read -r stat < /proc/$pid/stat || exit 0
+set -- ${stat##*) }
+if [ "$3" = "$pid" ]; then kill -$sig -$pid; else kill -$sig $pid; fi`
+)
+
+// runDockerExec executes the job in the existing container
+func runDockerExec(j *Job) {
+	ctx, cancel := j.runContext()
+	defer cancel()
+
+	j.success = false
+	j.exitStatus = 1
+
+	client, err := j.service.dockerAPI()
+	if err != nil {
+		log.Printf("[%s] cant connect to docker: %v\n", j.config.Name, err)
+		return
+	}
+
+	container := j.config.Docker.Container
+
+	if err := checkContainerRunning(ctx, client, container); err != nil {
+		log.Printf("[%s] cant run command: %v\n", j.config.Name, err)
+		return
+	}
+
+	env, err := dockerEnv(j)
+	if err != nil {
+		log.Printf("[%s] cant prepare command: %v\n", j.config.Name, err)
+		return
+	}
+
+	pidFile := "/tmp/" + containerName(j) + ".pid"
+	config := &dockerExecConfig{
+		Cmd:          append([]string{"sh", "-c", dockerExecWrapper, "cron2", pidFile}, dockerCommand(j)...),
+		Env:          env,
+		WorkingDir:   j.config.Dir,
+		User:         j.config.Docker.User,
+		AttachStdout: true,
+		AttachStderr: true,
+	}
+	if config.User == "" {
+		config.User = j.config.User
+	}
+
+	out, err := j.openOutput()
+	if err != nil {
+		return
+	}
+	defer out.Close()
+
+	id, err := client.createExec(ctx, container, config)
+	if err != nil {
+		log.Printf("[%s] cant create exec in container %s: %v\n", j.config.Name, container, err)
+		return
+	}
+
+	// Output stream ends when the process exits
+	streamDone := make(chan error, 1)
+	go func() {
+		streamDone <- client.startExec(context.Background(), id, out.stdout, out.stderr)
+	}()
+
+	kill := func(sig syscall.Signal) error {
+		return killExec(client, container, config.User, pidFile, sig)
+	}
+	j.service.state.setKill(j, kill)
+	defer j.service.state.setKill(j, nil)
+
+	var streamErr error
+	select {
+	case streamErr = <-streamDone:
+	case <-ctx.Done():
+		log.Printf("[%s] killing command in container %s\n", j.config.Name, container)
+		if err := kill(syscall.SIGKILL); err != nil {
+			log.Printf("[%s] cant kill command: %v\n", j.config.Name, err)
+		}
+
+		select {
+		case streamErr = <-streamDone:
+		case <-time.After(dockerRequestTimeout):
+			streamErr = errors.New("command is still running after kill")
+		}
+	}
+
+	// Command state is unknown without the stream
+	if streamErr != nil {
+		j.finish(ctx, 1, streamErr)
+		return
+	}
+
+	ictx, cancel := context.WithTimeout(context.Background(), dockerRequestTimeout)
+	defer cancel()
+
+	state, err := client.inspectExec(ictx, id)
+	if err != nil {
+		j.finish(ctx, 1, err)
+		return
+	}
+	j.finish(ctx, state.ExitCode, nil)
+}
+
+// killExec sends the signal to the command through another exec in the
+// container. Nothing is signalled when the command has already exited.
+func killExec(client *dockerClient, container string, user string, pidFile string, sig syscall.Signal) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerRequestTimeout)
+	defer cancel()
+
+	config := &dockerExecConfig{
+		Cmd:          []string{"sh", "-c", dockerExecKill, "cron2", pidFile, strconv.Itoa(int(sig))},
+		User:         user,
+		AttachStdout: true,
+		AttachStderr: true,
+	}
+	id, err := client.createExec(ctx, container, config)
+	if err != nil {
+		return err
+	}
+
+	out := &bytes.Buffer{}
+	if err := client.startExec(ctx, id, out, out); err != nil {
+		return err
+	}
+
+	state, err := client.inspectExec(ctx, id)
+	if err != nil {
+		return err
+	}
+	if state.ExitCode != 0 {
+		return fmt.Errorf("kill exited with %d: %s", state.ExitCode, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+// checkContainerRunning returns an error if the container does not exist or
+// is not running
+func checkContainerRunning(ctx context.Context, client *dockerClient, container string) error {
+	state, err := client.inspectContainer(ctx, container)
+	if err != nil {
+		if apiErr, ok := err.(*dockerError); ok && apiErr.Status == http.StatusNotFound {
+			return fmt.Errorf("container %q does not exist", container)
+		}
+		return err
+	}
+	if !state.Running {
+		return fmt.Errorf("container %q is not running, status: %s", container, state.Status)
+	}
+	return nil
+}
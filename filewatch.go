@@ -28,12 +28,7 @@ func startFilewatcher(service *Service, path string) {
 			if event.Op&fsnotify.Write == fsnotify.Write {
 				log.Println("config changed, reloading")
 
-				config, err := readConfig(path)
-				if err != nil {
-					log.Println("config error:", err)
-					continue
-				}
-				if err := service.reload(config); err != nil {
+				if _, err := service.reloadFile(); err != nil {
 					log.Println("reload error:", err)
 					continue
 				}
@@ -36,3 +36,35 @@ func checkHCLKeys(node ast.Node, valid []string) error {
 
 	return result
 }
+
+// findHCLKey returns the first item with the given key
+func findHCLKey(node ast.Node, key string) *ast.ObjectItem {
+	var list *ast.ObjectList
+	switch n := node.(type) {
+	case *ast.ObjectList:
+		list = n
+	case *ast.ObjectType:
+		list = n.List
+	default:
+		return nil
+	}
+
+	for _, item := range list.Items {
+		if len(item.Keys) > 0 && item.Keys[0].Token.Value().(string) == key {
+			return item
+		}
+	}
+	return nil
+}
+
+// hclFieldError adds the position to the validation error of the block. Field
+// errors point to the invalid attribute when it can be found.
+func hclFieldError(node ast.Node, err error) error {
+	pos := node.Pos()
+	if ferr, ok := err.(*fieldError); ok {
+		if item := findHCLKey(node, ferr.field); item != nil {
+			pos = item.Pos()
+		}
+	}
+	return fmt.Errorf("error at %s: %s", pos.String(), err.Error())
+}
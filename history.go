@@ -0,0 +1,19 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+func showHistory(socketPath string, job string) error {
+	_, err := sendRequest(socketPath, &request{Command: cmdHistory, Job: job}, func(data json.RawMessage) error {
+		run := &Run{}
+		if err := json.Unmarshal(data, run); err != nil {
+			return err
+		}
+
+		fmt.Println(run)
+		return nil
+	})
+	return err
+}
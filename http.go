@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default address of the HTTP listener
+const defaultHTTPListen = "127.0.0.1:8080"
+
+// dashboardTemplate renders the read-only jobs overview
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return "n/a"
+		}
+		return t.Format(time.RFC3339)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <meta http-equiv="refresh" content="30">
+  <title>cron2</title>
+  <style>
+    body { font-family: sans-serif; font-size: 14px; margin: 20px; }
+    table { border-collapse: collapse; width: 100%; }
+    th, td { text-align: left; padding: 6px 10px; border-bottom: 1px solid #ddd; }
+    .success { color: #2a7a2a; }
+    .failure, .timeout, .skipped, .replaced, .cancelled { color: #b22222; }
+    .inactive { color: #999; }
+  </style>
+</head>
+<body>
+  <h1>cron2</h1>
+  <table>
+    <tr>
+      <th>Job</th>
+      <th>Schedule</th>
+      <th>Next run</th>
+      <th>Running</th>
+      <th>Last run</th>
+      <th>Last result</th>
+      <th>Duration</th>
+    </tr>
+    {{range .}}
+    <tr class="{{.State}}">
+      <td>{{.Name}}</td>
+      <td><code>{{.Spec}}</code>{{if .Timezone}} ({{.Timezone}}){{end}}</td>
+      <td>{{if .NextRun}}{{time .NextRun}}{{else}}n/a{{end}}</td>
+      <td>{{.Running}}</td>
+      <td>{{time .LastStartedAt}}</td>
+      <td class="{{.LastResult}}">{{.LastResult}}{{if .LastResult}} ({{.LastExitStatus}}){{end}}</td>
+      <td>{{if .LastResult}}{{.LastDuration}}{{end}}</td>
+    </tr>
+    {{end}}
+  </table>
+</body>
+</html>
+`))
+
+// startHTTPServer starts the HTTP API and dashboard listener
+func startHTTPServer(service *Service, config *HTTPConfig) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleDashboard(service))
+	mux.HandleFunc("/api/jobs", handleJobs(service))
+	mux.HandleFunc("/api/jobs/", handleJob(service))
+	mux.HandleFunc("/api/runs/", handleRun(service))
+	mux.HandleFunc("/api/reload", handleReload(service))
+	mux.HandleFunc("/metrics", handleMetrics(service))
+
+	server := &http.Server{
+		Addr:         config.Listen,
+		Handler:      requireToken(config.Token, rejectCrossSite(mux)),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 60 * time.Second,
+	}
+
+	go func() {
+		<-service.stopped
+		server.Close()
+	}()
+
+	log.Println("starting http listener on", config.Listen)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// requireToken rejects requests without a valid token. Token could be passed
+// with "Authorization: Bearer" header or "token" query param.
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		given := r.URL.Query().Get("token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			given = strings.TrimPrefix(auth, "Bearer ")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "invalid token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rejectCrossSite rejects state changing requests that could be sent by a
+// browser from another site. Such requests can't have JSON content type
+// without a CORS preflight, which is never allowed.
+func rejectCrossSite(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+				writeError(w, http.StatusForbidden, errCodeInvalidRequest, "cross-origin requests are not allowed")
+				return
+			}
+		}
+
+		if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+			writeError(w, http.StatusUnsupportedMediaType, errCodeInvalidRequest, "content type must be application/json")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GET /
+func handleDashboard(service *Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := dashboardTemplate.Execute(w, service.jobStatuses()); err != nil {
+			log.Println("dashboard error:", err)
+		}
+	}
+}
+
+// GET /api/jobs
+func handleJobs(service *Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		writeJSON(w, http.StatusOK, service.jobStatuses())
+	}
+}
+
+// POST /api/jobs/:name/run
+// GET  /api/jobs/:name/history
+func handleJob(service *Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/api/jobs/")
+
+		idx := strings.LastIndex(path, "/")
+		if idx <= 0 {
+			writeError(w, http.StatusNotFound, errCodeInvalidCommand, "invalid command")
+			return
+		}
+		name, action := path[:idx], path[idx+1:]
+
+		switch action {
+		case cmdRun:
+			if !allowMethod(w, r, http.MethodPost) {
+				return
+			}
+			switch err := service.trigger(name, triggerHTTP); err {
+			case errJobNotFound:
+				writeError(w, http.StatusNotFound, errCodeNotFound, err.Error())
+			case errShuttingDown:
+				writeError(w, http.StatusServiceUnavailable, errCodeShuttingDown, err.Error())
+			default:
+				writeJSON(w, http.StatusAccepted, map[string]string{"message": "scheduled"})
+			}
+		case cmdHistory:
+			if !allowMethod(w, r, http.MethodGet) {
+				return
+			}
+			limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+			if limit <= 0 {
+				limit = historyLimit
+			}
+			writeJSON(w, http.StatusOK, service.history.list(name, limit))
+		default:
+			writeError(w, http.StatusNotFound, errCodeInvalidCommand, "invalid command")
+		}
+	}
+}
+
+// GET /api/runs/:id
+// GET /api/runs/:id/output
+func handleRun(service *Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+
+		chunks := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/runs/"), "/")
+		id, err := strconv.ParseInt(chunks[0], 10, 64)
+		if err != nil || len(chunks) > 2 || (len(chunks) == 2 && chunks[1] != "output") {
+			writeError(w, http.StatusNotFound, errCodeInvalidCommand, "invalid command")
+			return
+		}
+
+		run := service.history.find(id)
+		if run == nil {
+			writeError(w, http.StatusNotFound, errCodeNotFound, "run not found")
+			return
+		}
+
+		if len(chunks) == 1 {
+			writeJSON(w, http.StatusOK, run)
+			return
+		}
+
+		if run.Output == "" {
+			writeError(w, http.StatusNotFound, errCodeNotFound, "run has no output")
+			return
+		}
+		f, err := os.Open(run.Output)
+		if err != nil {
+			writeError(w, http.StatusNotFound, errCodeNotFound, "output is not available")
+			return
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeContent(w, r, "", run.FinishedAt, f)
+	}
+}
+
+// POST /api/reload
+func handleReload(service *Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+
+		diff, err := service.reloadFile()
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, errCodeInvalidConfig, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, diff)
+	}
+}
+
+// GET /metrics
+func handleMetrics(service *Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := service.metrics.write(w, service); err != nil {
+			log.Println("metrics error:", err)
+		}
+	}
+}
+
+// allowMethod rejects requests with unexpected HTTP method
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, errCodeInvalidRequest, "method not allowed")
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("http write error:", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeJSON(w, status, map[string]*responseErr{
+		"error": {Code: code, Message: message},
+	})
+}
@@ -1,78 +1,314 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
-	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
 	"os/user"
 	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 )
 
+const (
+	// Run triggers
+	triggerSchedule = "schedule"
+	triggerSocket   = "socket"
+	triggerHTTP     = "http"
+	triggerWatchdog = "watchdog"
+
+	// Run results
+	resultSuccess   = "success"
+	resultFailure   = "failure"
+	resultTimeout   = "timeout"
+	resultSkipped   = "skipped"
+	resultReplaced  = "replaced"
+	resultCancelled = "cancelled"
+	resultMissed    = "missed" // No successful runs within the expected window
+)
+
 // Job represents the cron job
 type Job struct {
-	config     *JobConfig
-	startedAt  time.Time
-	duration   time.Duration
-	success    bool
-	exitStatus int
-	running    bool
+	config        *JobConfig
+	service       *Service
+	trigger       string
+	id            int64
+	ctx           context.Context
+	instance      *runInstance
+	attempt       int
+	startedAt     time.Time
+	duration      time.Duration
+	success       bool
+	timedOut      bool
+	result        string
+	exitStatus    int
+	outputPath    string
+	oomKilled     bool
+	lingering     []lingeringProcess
+	notifications []notifyResult
+	output        *tailBuffer
 }
 
-// Run executes the job
+// Run executes the job. Value receiver gives every run its own copy of the
+// job, shared runtime state is kept in the service state registry.
 func (j Job) Run() {
-	j.running = true
+	if !j.service.begin() {
+		log.Printf("[%s] service is shutting down, skipping run\n", j.config.Name)
+		return
+	}
+	defer j.service.end()
+
+	j.id = j.service.history.nextID()
 	j.startedAt = time.Now()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j.ctx = ctx
+
+	// Check if the run is allowed by concurrency policy
+	replaced, ok := j.service.state.acquire(&j, cancel)
+	if !ok {
+		j.result = resultSkipped
+		log.Printf("[%s] job skipped, max number of instances is running\n", j.config.Name)
+		j.service.metrics.observe(&j)
+
+		sendNotifications(&j)
+		j.save()
+		return
+	}
+	for _, id := range replaced {
+		log.Printf("[%s] job run #%d is replaced by #%d\n", j.config.Name, id, j.id)
+	}
+
+	defer j.service.state.release(&j)
+
+	for j.attempt = 1; ; j.attempt++ {
+		j.execute()
+
+		// Retry is decided once, held notifications depend on it
+		retry := j.shouldRetry()
+		j.report(retry)
+		if !retry {
+			break
+		}
+
+		delay := j.config.Retry.delay(j.attempt)
+		log.Printf("[%s] retrying in %v\n", j.config.Name, delay)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			log.Printf("[%s] retry is cancelled\n", j.config.Name)
+			j.reportHeld()
+			return
+		case <-j.service.done:
+			log.Printf("[%s] retry is cancelled, service is shutting down\n", j.config.Name)
+			j.reportHeld()
+			return
+		}
+
+		// Every attempt gets its own run record
+		j.id = j.service.history.nextID()
+		j.startedAt = time.Now()
+		j.exitStatus = 0
+		j.timedOut = false
+		j.outputPath = ""
+		j.oomKilled = false
+		j.lingering = nil
+		j.notifications = nil
+	}
+}
+
+// execute performs a single attempt of the job run
+func (j *Job) execute() {
+	j.output = newTailBuffer(tailBufferSize)
 	log.Printf("[%s] job started\n", j.config.Name)
 
 	switch j.config.RunMode {
 	case nativeMode:
-		runNative(&j)
+		runNative(j)
 	case dockerMode:
-		runDocker(&j)
+		runDocker(j)
 	}
 
-	j.running = false
 	j.duration = time.Since(j.startedAt)
+	if j.config.Output != nil {
+		j.config.Output.rotate(j.config.Name)
+	}
+
+	reason := j.service.state.stopReason(j)
+	switch {
+	case reason != "":
+		j.result = reason
+		j.success = false
+	case j.success:
+		j.result = resultSuccess
+	case j.timedOut:
+		j.result = resultTimeout
+	default:
+		j.result = resultFailure
+	}
+	j.service.state.update(j)
+	j.service.metrics.observe(j)
+
 	log.Printf(
-		"[%s] job finished with %d. success: %v, duration: %v,\n",
+		"[%s] job finished with %d. result: %s, duration: %v,\n",
 		j.config.Name,
 		j.exitStatus,
-		j.success,
+		j.result,
 		j.duration,
 	)
+}
 
-	sendNotifications(&j)
+// report sends notifications of the attempt and saves its record.
+// Notifications are held off while the run is going to be retried.
+func (j *Job) report(retry bool) {
+	if !retry || !j.holdsNotifications() {
+		sendNotifications(j)
+	}
+	j.save()
 }
 
-// runNative executes the job on the host system
-func runNative(j *Job) {
-	var ctx context.Context
-	var cancelFunc context.CancelFunc
+// reportHeld sends notifications held off for the last attempt, when the
+// retry did not happen, and updates its saved record
+func (j *Job) reportHeld() {
+	if !j.holdsNotifications() {
+		return
+	}
+
+	sendNotifications(j)
+	if len(j.notifications) == 0 {
+		return
+	}
+	if err := j.service.history.update(j.record()); err != nil {
+		log.Printf("[%s] cant save run history: %v\n", j.config.Name, err)
+	}
+}
+
+// holdsNotifications returns true if notifications are sent on the final
+// attempt only
+func (j *Job) holdsNotifications() bool {
+	return j.config.Notify != nil && j.config.Notify.Retries != notifyRetriesAll
+}
+
+// failed returns true if the run result is a failure of the job command
+func failed(result string) bool {
+	return result == resultFailure || result == resultTimeout
+}
+
+// maxAttempts returns the total number of allowed attempts
+func (j *Job) maxAttempts() int {
+	if j.config.Retry == nil {
+		return 1
+	}
+	return j.config.Retry.Attempts
+}
+
+// shouldRetry returns true if the failed run needs another attempt
+func (j *Job) shouldRetry() bool {
+	if !failed(j.result) || j.attempt >= j.maxAttempts() {
+		return false
+	}
+	if j.ctx.Err() != nil || j.service.isStopping() {
+		return false
+	}
+	return j.config.Retry.matches(j.exitStatus, j.timedOut)
+}
+
+// save writes the run record into history
+func (j *Job) save() {
+	if err := j.service.history.add(j.record()); err != nil {
+		log.Printf("[%s] cant save run history: %v\n", j.config.Name, err)
+	}
+}
+
+// record returns the history record of the run
+func (j *Job) record() *Run {
+	return &Run{
+		ID:            j.id,
+		Job:           j.config.Name,
+		Trigger:       j.trigger,
+		StartedAt:     j.startedAt,
+		FinishedAt:    j.startedAt.Add(j.duration),
+		Duration:      j.duration,
+		Success:       j.success,
+		Result:        j.result,
+		Attempt:       j.attempt,
+		ExitStatus:    j.exitStatus,
+		Output:        j.outputPath,
+		OOMKilled:     j.oomKilled,
+		Lingering:     j.lingering,
+		Notifications: j.notifications,
+	}
+}
+
+// runContext returns the context of the run attempt, it is done when the run
+// is cancelled or the job timeout is reached
+func (j *Job) runContext() (context.Context, context.CancelFunc) {
+	if j.config.Timeout > 0 {
+		return context.WithTimeout(j.ctx, j.config.Timeout)
+	}
+	return context.WithCancel(j.ctx)
+}
+
+// openOutput prepares output destinations for the run
+func (j *Job) openOutput() (*runOutput, error) {
+	out, err := openRunOutput(j)
+	if err != nil {
+		log.Printf("[%s] cant open output file: %v\n", j.config.Name, err)
+		j.exitStatus = 1
+		j.success = false
+		return nil, err
+	}
+	j.outputPath = out.path
+	return out, nil
+}
+
+// finish sets the result of the run from the command exit status
+func (j *Job) finish(ctx context.Context, status int, err error) {
+	j.exitStatus = status
+	j.success = status == 0 && err == nil
+
+	// Command may exit cleanly on the kill signal, the run has failed anyway
+	if ctx.Err() == context.DeadlineExceeded {
+		j.success = false
+		j.timedOut = true
+	}
+
+	if err != nil {
+		log.Printf("[%s] execution error: %v\n", j.config.Name, err)
+	} else if status != 0 {
+		log.Printf("[%s] execution error: exited with %d\n", j.config.Name, status)
+	}
+}
 
-	ctx = context.Background()
-	if j.config.Timeout.Seconds() > 0 {
-		ctx, cancelFunc = context.WithTimeout(ctx, j.config.Timeout)
-		defer cancelFunc()
+// exitStatus returns the exit status of the command from its wait error
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exiterr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
 	}
+	return 1
+}
+
+// runNative executes the job on the host system
+func runNative(j *Job) {
+	ctx, cancel := j.runContext()
+	defer cancel()
 
 	var cmd *exec.Cmd
 	if j.config.Shell != "" {
-		cmd = exec.CommandContext(ctx, j.config.Shell)
+		cmd = exec.Command(j.config.Shell)
 		cmd.Stdin = strings.NewReader(strings.TrimSpace(j.config.Command) + "\n")
 	} else {
-		chunks := strings.Split(j.config.Command, " ")
-		cmd = exec.CommandContext(ctx, chunks[0], chunks[1:]...)
+		cmd = exec.Command(j.config.Argv[0], j.config.Argv[1:]...)
 	}
 
 	// Run is custom directory
@@ -87,6 +323,12 @@ func runNative(j *Job) {
 		}
 	}
 
+	// Run ID lets the service find processes left by the command
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, runIDEnv(j))
+
 	// Run as a different user
 	if j.config.User != "" {
 		usr, err := user.Lookup(j.config.User)
@@ -103,159 +345,166 @@ func runNative(j *Job) {
 		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
 	}
 
-	// Default output
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	// Prepare log file for the run
-	if j.config.Log != "" {
-		f, err := os.OpenFile(j.config.Log, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-		if err != nil {
-			log.Printf("[%s] cant open log file:", err)
-		}
-		logFile := bufio.NewWriter(f)
-
-		cmd.Stdout = logFile
-		cmd.Stderr = logFile
-
-		defer func() {
-			logFile.Flush()
-			f.Close()
-		}()
+	out, err := j.openOutput()
+	if err != nil {
+		return
 	}
+	defer out.Close()
 
-	j.success = true
-
-	if err := cmd.Run(); err != nil {
+	pipes, err := pipeOutput(cmd, out)
+	if err != nil {
+		log.Printf("[%s] cant open output: %v\n", j.config.Name, err)
+		j.exitStatus = 1
 		j.success = false
-
-		if exiterr, ok := err.(*exec.ExitError); ok {
-			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-				j.exitStatus = status.ExitStatus()
-			}
-		}
-		log.Printf("[%s] execution error: %v\n", j.config.Name, err)
 		return
 	}
-}
 
-// runDocker executes the job in a docker container
-func runDocker(j *Job) {
-	args := []string{
-		"docker",
-		"run",
-		"-i",   // interfactive mode
-		"--rm", // remove container after execution
-	}
+	err = runCommand(ctx, j, cmd)
+	closeOutput(j, pipes)
 
-	// Working directory inside container
-	if j.config.Dir != "" {
-		args = append(args, "--workir", j.config.Dir)
+	j.finish(ctx, exitStatus(err), err)
+}
+
+// runCommand starts the command in its own process group and waits for it
+// to finish. Process group lets the service signal all of the job processes.
+// The process group is terminated when the context is done.
+func runCommand(ctx context.Context, j *Job, cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
 	}
+	cmd.SysProcAttr.Setpgid = true
 
-	// Append env vars
-	for k, v := range j.config.Environment {
-		args = append(args, "-e", k+"="+v)
+	if err := cmd.Start(); err != nil {
+		return err
 	}
+	pgid := cmd.Process.Pid
 
-	// Run command also needs splitting
-	args = append(args, j.config.Docker.Image)
-	args = append(args, strings.Split(j.config.Command, " ")...)
+	j.service.state.setProcess(j, pgid)
+	defer j.service.state.setProcess(j, 0)
 
-	log.Println("command:", strings.Join(args, " "))
+	// Descendants are tracked while the command is running
+	tracker := newProcessTracker(pgid, runIDEnv(j))
 
-	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	finished := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
 
-	j.success = true
+		ticker := time.NewTicker(trackInterval)
+		defer ticker.Stop()
 
-	if err := cmd.Run(); err != nil {
-		j.success = false
-		if exiterr, ok := err.(*exec.ExitError); ok {
-			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-				j.exitStatus = status.ExitStatus()
+		for {
+			select {
+			case <-ctx.Done():
+				terminateProcessGroup(j, pgid)
+				return
+			case <-ticker.C:
+				tracker.scan()
+			case <-finished:
+				return
 			}
 		}
-		log.Printf("[%s] execution error: %v\n", j.config.Name, err)
-		return
-	}
+	}()
+
+	err := cmd.Wait()
+	close(finished)
+	<-stopped
+
+	j.lingering = checkLingering(j, tracker)
+
+	return err
 }
 
-// sendNotifications sends alerts to all notification targets
-func sendNotifications(j *Job) {
-	notify := j.config.Notify
-	if notify == nil {
-		return
+// runIDEnv returns the env var with the run ID, set for native commands
+func runIDEnv(j *Job) string {
+	return "CRON2_RUN_ID=" + strconv.FormatInt(j.id, 10)
+}
+
+// terminateProcessGroup sends the kill signal to the process group and kills
+// it if any of its processes is running after the kill timeout
+func terminateProcessGroup(j *Job, pgid int) {
+	sig := j.config.KillSignal
+
+	log.Printf("[%s] sending %v to process group %d\n", j.config.Name, sig, pgid)
+	if err := syscall.Kill(-pgid, sig); err != nil {
+		log.Printf("[%s] cant signal process group %d: %v\n", j.config.Name, pgid, err)
 	}
-	if notify.Mode == notifyError && j.success == true {
+	if sig == syscall.SIGKILL {
 		return
 	}
 
-	var message string
-	if j.success {
-		message = fmt.Sprintf("Job %q has finished. Duration: %v", j.config.Name, j.duration)
-	} else {
-		message = fmt.Sprintf("Job %q has failed with status code: %v. Duration: %v", j.config.Name, j.exitStatus, j.duration)
+	// Processes of the group may outlive the command, so the group is
+	// waited for instead of the command
+	deadline := time.Now().Add(j.config.KillTimeout)
+	for groupRunning(pgid) {
+		if time.Now().After(deadline) {
+			log.Printf("[%s] process group %d is still running after %v, killing\n", j.config.Name, pgid, j.config.KillTimeout)
+			break
+		}
+		time.Sleep(killPollInterval)
 	}
 
-	log.Printf("[%s] sending notifications\n", j.config.Name)
-	defer log.Printf("[%s] done sending notifications\n", j.config.Name)
-
-	wg := &sync.WaitGroup{}
+	// Group is killed anyway, processes could join it between the checks
+	if err := syscall.Kill(-pgid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		log.Printf("[%s] cant kill process group %d: %v\n", j.config.Name, pgid, err)
+	}
+}
 
-	if webhook := notify.Webhook; webhook != nil {
-		wg.Add(1)
+// runDocker executes the job in a docker container
+func runDocker(j *Job) {
+	if j.config.Docker.Container != "" {
+		runDockerExec(j)
+		return
+	}
+	if j.config.Docker.Executor == dockerExecutorCLI {
+		runDockerCLI(j)
+		return
+	}
+	runDockerAPI(j)
+}
 
-		go func() {
-			defer wg.Done()
+// runDockerCLI executes the job in a docker container with the docker client
+func runDockerCLI(j *Job) {
+	ctx, cancel := j.runContext()
+	defer cancel()
 
-			form := url.Values{}
-			form.Add("job_name", j.config.Name)
-			form.Add("duration", fmt.Sprintf("%v", j.duration))
-			form.Add("started_at", fmt.Sprintf("%v", j.startedAt))
-			form.Add("success", fmt.Sprintf("%v", j.success))
-			form.Add("exit_status", fmt.Sprintf("%v", j.exitStatus))
-			form.Add("message", message)
+	name := containerName(j)
+	args := dockerRunArgs(j, name)
 
-			resp, err := http.PostForm(webhook.URL, form)
-			if err != nil {
-				log.Printf("[%s] failed to send webhook: %v\n", j.config.Name, err)
-				return
-			}
-			resp.Body.Close()
+	log.Printf("[%s] command: docker %s\n", j.config.Name, strings.Join(args, " "))
 
-			log.Printf("[%s] sent notification to webhook %v\n", j.config.Name, webhook.URL)
-		}()
+	out, err := j.openOutput()
+	if err != nil {
+		return
 	}
+	defer out.Close()
 
-	if slack := notify.Slack; slack != nil {
-		wg.Add(1)
-
-		go func() {
-			defer wg.Done()
+	cmd := exec.Command("docker", args...)
+	cmd.Stdout = out.stdout
+	cmd.Stderr = out.stderr
 
-			payload := map[string]string{
-				"text":     message,
-				"username": slack.User,
-				"channel":  slack.Channel,
-			}
-			body, err := json.Marshal(payload)
-			if err != nil {
-				log.Printf("[%s] json error: %v\n", j.config.Name, err)
-				return
-			}
+	// Shell reads the command from stdin inside the container
+	if j.config.Shell != "" {
+		cmd.Stdin = strings.NewReader(strings.TrimSpace(j.config.Command) + "\n")
+	}
 
-			resp, err := http.Post(slack.URL, "application/json", bytes.NewReader(body))
-			if err != nil {
-				log.Printf("[%s] failed to send slack: %v\n", j.config.Name, err)
-				return
-			}
-			resp.Body.Close()
+	// Killing the docker client does not stop the container, so the
+	// container is stopped and removed on timeout or cancellation
+	finished := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			stopContainer(j, name)
+		case <-finished:
+		}
+	}()
 
-			log.Printf("[%s] sent notification to slack %v\n", j.config.Name, slack.Channel)
-		}()
-	}
+	// Docker client is not signalled, the container is stopped instead
+	err = runCommand(context.Background(), j, cmd)
+	close(finished)
+	<-stopped
 
-	wg.Wait()
+	j.finish(ctx, exitStatus(err), err)
 }
@@ -1,9 +1,17 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/sosedoff/cron"
@@ -17,51 +25,342 @@ const (
 	nativeMode = "native"
 	dockerMode = "docker"
 
+	// Concurrency policies
+	concurrencyAllow   = "allow"
+	concurrencyForbid  = "forbid"
+	concurrencyReplace = "replace"
+
+	// Reload policies for running instances of removed or changed jobs
+	reloadKeep = "keep"
+	reloadStop = "stop"
+
+	// Policies for processes left running by the job command
+	exitKeep = "keep"
+	exitKill = "kill"
+
 	// Notification modes
-	notifyError = "error"
-	notifyAll   = "all"
+	notifyError  = "error"
+	notifyAll    = "all"
+	notifyChange = "change"
+
+	// Notification modes for retried runs
+	notifyRetriesFinal = "final"
+	notifyRetriesAll   = "all"
+
+	// Retry defaults
+	defaultRetryDelay   = 10 * time.Second
+	defaultRetryBackoff = 2.0
+
+	// Time given to the job processes to exit before they are killed
+	defaultKillTimeout = 10 * time.Second
 )
 
+// signals contains signals allowed in the kill_signal option
+var signals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+	"SIGTERM": syscall.SIGTERM,
+}
+
+// parseSignal returns the signal by name, e.g. "SIGTERM" or "term"
+func parseSignal(name string) (syscall.Signal, error) {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig, ok := signals[name]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unsupported signal: %q", name)
+}
+
 // JobConfig represents a single job in the configuration file
 type JobConfig struct {
-	ID            int               `hcl:"-"`        // Internal entry ID
-	Disabled      bool              `hcl:"disabled"` // Availability flag
-	Name          string            `hcl:"name"`     // Command name
-	Spec          string            `hcl:"spec"`     // Cron expression
-	Timezone      string            `hcl:"tz"`       // Time zone
-	Command       string            `hcl:"command"`  // Run command
-	User          string            `hcl:"user"`     // Run as user
-	Dir           string            `hcl:"dir"`      // Working dir
-	Environment   map[string]string `hcl:"env"`      // Env vars
-	Log           string            `hcl:"log"`      // Path to log file
-	Shell         string            `hcl:"shell"`    // Shell to use for the run
-	TimeoutString string            `hcl:"timeout"`  // Max execution time
-	Docker        *DockerConfig     `hcl:"docker"`   // Docker options
-	Notify        *NotifyConfig     `hcl:"notify"`   // Notification options
+	ID            int               `hcl:"-" json:"-"`    // Internal entry ID
+	Disabled      bool              `hcl:"disabled"`      // Availability flag
+	Name          string            `hcl:"name"`          // Command name
+	Spec          string            `hcl:"spec"`          // Cron expression
+	Timezone      string            `hcl:"tz"`            // Time zone
+	Command       string            `hcl:"command"`       // Run command
+	Args          []string          `hcl:"args"`          // Run command as a list of arguments
+	User          string            `hcl:"user"`          // Run as user
+	Dir           string            `hcl:"dir"`           // Working dir
+	Environment   map[string]string `hcl:"env"`           // Env vars
+	Log           string            `hcl:"log"`           // Path to log file
+	Output        *OutputConfig     `hcl:"output"`        // Output capture options
+	Shell         string            `hcl:"shell"`         // Shell to use for the run
+	TimeoutString string            `hcl:"timeout"`       // Max execution time
+	Docker        *DockerConfig     `hcl:"docker"`        // Docker options
+	Notify        *NotifyConfig     `hcl:"-"`             // Notification options
+	Concurrency   string            `hcl:"concurrency"`   // Overlapping runs policy
+	MaxInstances  int               `hcl:"max_instances"` // Max number of running instances
+	Retry         *RetryConfig      `hcl:"retry"`         // Retry options
+	OnReload      string            `hcl:"on_reload"`     // Reload policy for running instances
+
+	// Max time since the last successful run before alerting
+	ExpectSuccessWithinString string `hcl:"expect_success_within"`
+
+	// Signal sent to the job processes on timeout, and the time given to
+	// them to exit before they are killed
+	KillSignalString  string `hcl:"kill_signal"`
+	KillTimeoutString string `hcl:"kill_timeout"`
+
+	// What to do with processes left running when the command exits
+	OnExit string `hcl:"on_exit"`
 
 	// Computed fields
-	RunMode string        `hcl:"-"`
-	Timeout time.Duration `hcl:"-"`
+	RunMode             string         `hcl:"-"`
+	Timeout             time.Duration  `hcl:"-"`
+	KillSignal          syscall.Signal `hcl:"-"`
+	KillTimeout         time.Duration  `hcl:"-"`
+	Argv                []string       `hcl:"-"` // Command arguments when running without shell
+	ExpectSuccessWithin time.Duration  `hcl:"-"`
+}
+
+// fieldError represents a validation error of the specific job attribute
+type fieldError struct {
+	field string
+	err   error
+}
+
+func (e *fieldError) Error() string {
+	return fmt.Sprintf("invalid %s: %v", e.field, e.err)
 }
 
 // NotifyConfig represents job notification settings
 type NotifyConfig struct {
-	Mode string `hcl:"on"` // Mode could be one of "errors", "all"
+	Mode          string   `hcl:"on"`      // Mode could be one of "error", "all", "change"
+	Retries       string   `hcl:"retries"` // Notify on "final" attempt or "all" attempts
+	Redact        []string `hcl:"redact"`  // Patterns to remove from the output
+	Message       string   `hcl:"message"` // Message template for all targets
+	After         int      `hcl:"after"`   // Number of consecutive failures before alerting
+	RealertString string   `hcl:"realert"` // Min interval between alerts while the job is failing
+
+	// Notification targets, parsed from the nested blocks
+	Notifiers []Notifier `hcl:"-"`
+
+	// Computed fields
+	Realert         time.Duration `hcl:"-"`
+	redactPatterns  []*regexp.Regexp
+	messageTemplate *template.Template
+}
+
+// validate sets defaults and compiles patterns and templates of the
+// notification settings
+func (n *NotifyConfig) validate(job *JobConfig) error {
+	// Notify on errors only by default
+	switch n.Mode {
+	case "":
+		n.Mode = notifyError
+	case notifyError, notifyAll, notifyChange:
+	default:
+		return &fieldError{field: "on", err: fmt.Errorf("%q", n.Mode)}
+	}
 
-	Webhook *struct {
-		URL string `hcl:"url"`
-	} `hcl:"webhook"`
+	if n.After < 0 {
+		return &fieldError{field: "after", err: errors.New("must not be negative")}
+	}
 
-	Slack *struct {
-		URL     string `hcl:"url"`
-		User    string `hcl:"username"`
-		Channel string `hcl:"channel"`
-	} `hcl:"slack"`
+	if n.RealertString != "" {
+		dur, err := time.ParseDuration(n.RealertString)
+		if err != nil {
+			return &fieldError{field: "realert", err: err}
+		}
+		n.Realert = dur
+	}
+
+	switch n.Retries {
+	case "":
+		n.Retries = notifyRetriesFinal
+	case notifyRetriesFinal, notifyRetriesAll:
+	default:
+		return &fieldError{field: "retries", err: fmt.Errorf("%q", n.Retries)}
+	}
+
+	for _, pattern := range n.Redact {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return &fieldError{field: "redact", err: fmt.Errorf("pattern %q: %v", pattern, err)}
+		}
+		n.redactPatterns = append(n.redactPatterns, re)
+	}
+
+	if n.Message != "" {
+		tmpl, err := parseMessageTemplate("message", n.Message, job)
+		if err != nil {
+			return &fieldError{field: "message", err: err}
+		}
+		n.messageTemplate = tmpl
+	}
+
+	return nil
+}
+
+// OutputConfig represents run output capture settings
+type OutputConfig struct {
+	Path       string `hcl:"path"`        // Output path template
+	StderrPath string `hcl:"stderr_path"` // Separate stderr path template
+	Timestamps bool   `hcl:"timestamps"`  // Prefix every line with time
+	MaxBytes   int64  `hcl:"max_bytes"`   // Max output size per run
+	KeepRuns   int    `hcl:"keep_runs"`   // Number of run outputs to keep
+	KeepDays   int    `hcl:"keep_days"`   // Number of days to keep run outputs
+
+	// Computed fields
+	pathTemplate   *template.Template
+	stderrTemplate *template.Template
+}
+
+// RetryConfig represents retry settings for failed runs
+type RetryConfig struct {
+	Attempts       int     `hcl:"attempts"`   // Max number of attempts, including the first one
+	DelayString    string  `hcl:"delay"`      // Delay before the first retry
+	Backoff        float64 `hcl:"backoff"`    // Delay multiplier for every next attempt
+	MaxDelayString string  `hcl:"max_delay"`  // Max delay between attempts
+	ExitCodes      []int   `hcl:"exit_codes"` // Retry only on these exit codes
+	OnTimeout      bool    `hcl:"on_timeout"` // Retry when the run has timed out
+
+	// Computed fields
+	Delay    time.Duration `hcl:"-"`
+	MaxDelay time.Duration `hcl:"-"`
 }
 
 // DockerConfig represends config options for docker run
 type DockerConfig struct {
-	Image string `hcl:"image"`
+	Image      string            `hcl:"image"`
+	Container  string            `hcl:"container"`  // Run in the existing container instead
+	Volumes    []string          `hcl:"volumes"`    // Volume mounts, "src:dst[:opts]"
+	Network    string            `hcl:"network"`    // Network to connect the container to
+	User       string            `hcl:"user"`       // User inside the container, job user by default
+	Entrypoint string            `hcl:"entrypoint"` // Override the image entrypoint
+	Memory     string            `hcl:"memory"`     // Memory limit, e.g. "512m"
+	CPUs       float64           `hcl:"cpus"`       // Number of CPUs
+	Pull       string            `hcl:"pull"`       // Pull policy: "always", "missing", "never"
+	Labels     map[string]string `hcl:"labels"`     // Container labels
+	EnvFile    string            `hcl:"env_file"`   // File with env vars
+	Executor   string            `hcl:"executor"`   // Run with "cli" (default) or "api"
+}
+
+// Docker image pull policies
+const (
+	dockerPullAlways  = "always"
+	dockerPullMissing = "missing"
+	dockerPullNever   = "never"
+)
+
+// Docker executors
+const (
+	dockerExecutorAPI = "api" // Docker Engine API
+	dockerExecutorCLI = "cli" // docker command line client
+)
+
+// dockerMemoryPattern matches memory limits, e.g. "512m" or "2g"
+var dockerMemoryPattern = regexp.MustCompile(`^[0-9]+[bkmgBKMG]?$`)
+
+// validate performs validation on docker attributes
+func (d *DockerConfig) validate() error {
+	if d.Container != "" {
+		return d.validateExec()
+	}
+
+	if d.Image == "" {
+		return errors.New("image or container is required")
+	}
+
+	switch d.Pull {
+	case "":
+		d.Pull = dockerPullMissing
+	case dockerPullAlways, dockerPullMissing, dockerPullNever:
+	default:
+		return fmt.Errorf("invalid pull policy: %q", d.Pull)
+	}
+
+	switch d.Executor {
+	case "":
+		d.Executor = dockerExecutorCLI
+	case dockerExecutorAPI, dockerExecutorCLI:
+	default:
+		return fmt.Errorf("invalid executor: %q", d.Executor)
+	}
+
+	if d.Memory != "" && !dockerMemoryPattern.MatchString(d.Memory) {
+		return fmt.Errorf("invalid memory limit: %q", d.Memory)
+	}
+	if d.CPUs < 0 {
+		return errors.New("cpus must not be negative")
+	}
+
+	for _, volume := range d.Volumes {
+		if parts := strings.Split(volume, ":"); len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("invalid volume: %q", volume)
+		}
+	}
+
+	return nil
+}
+
+// validateExec performs validation of attributes of the command running in
+// the existing container
+func (d *DockerConfig) validateExec() error {
+	if d.Image != "" {
+		return errors.New("image and container can not be used together")
+	}
+
+	switch d.Executor {
+	case "", dockerExecutorAPI:
+		d.Executor = dockerExecutorAPI
+	case dockerExecutorCLI:
+		return errors.New("container is not supported by cli executor")
+	default:
+		return fmt.Errorf("invalid executor: %q", d.Executor)
+	}
+
+	// Container settings are fixed when the container is created
+	unsupported := map[string]bool{
+		"volumes":    len(d.Volumes) > 0,
+		"network":    d.Network != "",
+		"entrypoint": d.Entrypoint != "",
+		"memory":     d.Memory != "",
+		"cpus":       d.CPUs != 0,
+		"pull":       d.Pull != "",
+		"labels":     len(d.Labels) > 0,
+	}
+	for _, key := range []string{"volumes", "network", "entrypoint", "memory", "cpus", "pull", "labels"} {
+		if unsupported[key] {
+			return fmt.Errorf("%s can not be used with container", key)
+		}
+	}
+
+	return nil
+}
+
+// memoryBytes returns the memory limit in bytes
+func (d *DockerConfig) memoryBytes() int64 {
+	if d.Memory == "" {
+		return 0
+	}
+
+	value := strings.ToLower(d.Memory)
+	unit := int64(1)
+	switch value[len(value)-1] {
+	case 'b':
+		value = value[:len(value)-1]
+	case 'k':
+		unit = 1024
+		value = value[:len(value)-1]
+	case 'm':
+		unit = 1024 * 1024
+		value = value[:len(value)-1]
+	case 'g':
+		unit = 1024 * 1024 * 1024
+		value = value[:len(value)-1]
+	}
+
+	n, _ := strconv.ParseInt(value, 10, 64)
+	return n * unit
 }
 
 // state returns current job state
@@ -90,8 +389,21 @@ func (j *JobConfig) validate() error {
 		return errors.New("spec is required")
 	}
 
-	if j.Command == "" {
-		return errors.New("command is required")
+	if j.Command == "" && len(j.Args) == 0 {
+		return errors.New("command or args is required")
+	}
+
+	if len(j.Args) > 0 {
+		if j.Command != "" {
+			return errors.New("command and args can not be used together")
+		}
+		if j.Shell != "" {
+			return errors.New("args can not be used with shell")
+		}
+		if j.Args[0] == "" {
+			return &fieldError{field: "args", err: errors.New("program name is empty")}
+		}
+		j.Argv = j.Args
 	}
 
 	// Configure shell when multi-line scripts
@@ -99,6 +411,18 @@ func (j *JobConfig) validate() error {
 		j.Shell = defaultShell
 	}
 
+	// Split the command into arguments when running without shell
+	if j.Shell == "" && j.Command != "" {
+		argv, err := splitWords(j.Command, j.lookupEnv)
+		if err != nil {
+			return &fieldError{field: "command", err: err}
+		}
+		if len(argv) == 0 {
+			return &fieldError{field: "command", err: errors.New("command is empty")}
+		}
+		j.Argv = argv
+	}
+
 	if _, err := cron.Parse(j.Spec); err != nil {
 		return fmt.Errorf("invalid cron spec: %v", err)
 	}
@@ -111,20 +435,253 @@ func (j *JobConfig) validate() error {
 		j.Timeout = dur
 	}
 
+	j.KillSignal = syscall.SIGTERM
+	if val := j.KillSignalString; val != "" {
+		sig, err := parseSignal(val)
+		if err != nil {
+			return &fieldError{field: "kill_signal", err: err}
+		}
+		j.KillSignal = sig
+	}
+
+	j.KillTimeout = defaultKillTimeout
+	if val := j.KillTimeoutString; val != "" {
+		dur, err := time.ParseDuration(val)
+		if err != nil {
+			return &fieldError{field: "kill_timeout", err: err}
+		}
+		if dur < 0 {
+			return &fieldError{field: "kill_timeout", err: errors.New("must not be negative")}
+		}
+		j.KillTimeout = dur
+	}
+
+	if val := j.ExpectSuccessWithinString; val != "" {
+		dur, err := time.ParseDuration(val)
+		if err != nil {
+			return &fieldError{field: "expect_success_within", err: err}
+		}
+		if dur <= 0 {
+			return &fieldError{field: "expect_success_within", err: errors.New("must be positive")}
+		}
+		j.ExpectSuccessWithin = dur
+	}
+
+	switch j.Concurrency {
+	case "":
+		j.Concurrency = concurrencyAllow
+	case concurrencyAllow, concurrencyForbid, concurrencyReplace:
+	default:
+		return fmt.Errorf("invalid concurrency: %q", j.Concurrency)
+	}
+
+	if j.MaxInstances < 0 {
+		return errors.New("max_instances must not be negative")
+	}
+	if j.Concurrency == concurrencyForbid && j.MaxInstances > 1 {
+		return errors.New("max_instances can not be used with forbid concurrency")
+	}
+
+	switch j.OnReload {
+	case "":
+		j.OnReload = reloadKeep
+	case reloadKeep, reloadStop:
+	default:
+		return fmt.Errorf("invalid on_reload: %q", j.OnReload)
+	}
+
+	switch j.OnExit {
+	case "":
+		j.OnExit = exitKeep
+	case exitKeep, exitKill:
+	default:
+		return &fieldError{field: "on_exit", err: fmt.Errorf("%q", j.OnExit)}
+	}
+
 	if j.Docker != nil {
+		if j.OnExit != exitKeep {
+			return &fieldError{field: "on_exit", err: errors.New("can not be used with docker")}
+		}
+		if err := j.Docker.validate(); err != nil {
+			return &fieldError{field: "docker", err: err}
+		}
 		j.RunMode = dockerMode
 	} else {
 		j.RunMode = nativeMode
 	}
 
-	// Notify on errors only by default
-	if j.Notify != nil && j.Notify.Mode == "" {
-		j.Notify.Mode = notifyError
+	// Log file is a shorthand for output capture without rotation
+	if j.Log != "" {
+		if j.Output != nil {
+			return errors.New("log and output can not be used together")
+		}
+		j.Output = &OutputConfig{Path: j.Log}
+	}
+
+	if j.Output != nil {
+		if err := j.Output.validate(); err != nil {
+			return &fieldError{field: "output", err: err}
+		}
+	}
+
+	if j.Retry != nil {
+		if err := j.Retry.validate(); err != nil {
+			return fmt.Errorf("invalid retry: %v", err)
+		}
 	}
 
 	return nil
 }
 
+// instanceLimit returns max number of concurrent runs, zero means no limit
+func (j *JobConfig) instanceLimit() int {
+	switch j.Concurrency {
+	case concurrencyForbid:
+		return 1
+	case concurrencyReplace:
+		if j.MaxInstances == 0 {
+			return 1
+		}
+	}
+	return j.MaxInstances
+}
+
+// validate performs validation on output attributes
+func (o *OutputConfig) validate() error {
+	if o.Path == "" {
+		return errors.New("path is required")
+	}
+	if o.MaxBytes < 0 || o.KeepRuns < 0 || o.KeepDays < 0 {
+		return errors.New("limits must not be negative")
+	}
+
+	tmpl, err := parseOutputPath(o.Path)
+	if err != nil {
+		return err
+	}
+	o.pathTemplate = tmpl
+
+	if o.StderrPath != "" {
+		tmpl, err := parseOutputPath(o.StderrPath)
+		if err != nil {
+			return err
+		}
+		o.stderrTemplate = tmpl
+	}
+
+	// Rotation must not match output files of other jobs
+	if o.KeepRuns > 0 || o.KeepDays > 0 {
+		for _, tmpl := range []*template.Template{o.pathTemplate, o.stderrTemplate} {
+			if tmpl != nil && !dependsOnName(tmpl) {
+				return errors.New("path must include {{.Name}} when keep_runs or keep_days is set")
+			}
+		}
+	}
+
+	return nil
+}
+
+// dependsOnName returns true if the output path differs between jobs
+func dependsOnName(tmpl *template.Template) bool {
+	a, _ := renderOutputPath(tmpl, &outputVars{Name: "a"})
+	b, _ := renderOutputPath(tmpl, &outputVars{Name: "b"})
+	return a != b
+}
+
+// parseOutputPath parses the output path template and checks that it can
+// be rendered
+func parseOutputPath(path string) (*template.Template, error) {
+	tmpl, err := template.New("path").Parse(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path template: %v", err)
+	}
+	if _, err := renderOutputPath(tmpl, &outputVars{}); err != nil {
+		return nil, fmt.Errorf("invalid path template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// validate performs validation on retry attributes
+func (r *RetryConfig) validate() error {
+	if r.Attempts < 2 {
+		return errors.New("attempts must be greater than 1")
+	}
+
+	r.Delay = defaultRetryDelay
+	if val := r.DelayString; val != "" {
+		dur, err := time.ParseDuration(val)
+		if err != nil {
+			return fmt.Errorf("invalid delay: %v", err)
+		}
+		r.Delay = dur
+	}
+
+	if val := r.MaxDelayString; val != "" {
+		dur, err := time.ParseDuration(val)
+		if err != nil {
+			return fmt.Errorf("invalid max_delay: %v", err)
+		}
+		r.MaxDelay = dur
+	}
+
+	if r.Backoff == 0 {
+		r.Backoff = defaultRetryBackoff
+	}
+	if r.Backoff < 1 {
+		return errors.New("backoff must not be less than 1")
+	}
+
+	return nil
+}
+
+// delay returns the wait time before the next attempt
+func (r *RetryConfig) delay(attempt int) time.Duration {
+	delay := float64(r.Delay) * math.Pow(r.Backoff, float64(attempt-1))
+	if r.MaxDelay > 0 && delay > float64(r.MaxDelay) {
+		return r.MaxDelay
+	}
+	if delay > math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(delay)
+}
+
+// matches returns true if the failed run is eligible for retry
+func (r *RetryConfig) matches(exitStatus int, timedOut bool) bool {
+	// Retry on any failure when no conditions are set
+	if len(r.ExitCodes) == 0 && !r.OnTimeout {
+		return true
+	}
+	if timedOut {
+		return r.OnTimeout
+	}
+	for _, code := range r.ExitCodes {
+		if code == exitStatus {
+			return true
+		}
+	}
+	return false
+}
+
+// checksum returns a hash of the job configuration, used to detect changes
+// between config reloads
+func (j *JobConfig) checksum() string {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// lookupEnv returns the value of the job environment variable, falling back
+// to the service environment
+func (j *JobConfig) lookupEnv(name string) string {
+	if val, ok := j.Environment[name]; ok {
+		return val
+	}
+	return os.Getenv(name)
+}
+
 // nextRun returns the next expected execution time
 func (j *JobConfig) nextRun() (time.Time, error) {
 	var t time.Time
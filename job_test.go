@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingNotifier records the sent notifications
+type countingNotifier struct {
+	lock *sync.Mutex
+	sent []*notification
+}
+
+func newCountingNotifier() *countingNotifier {
+	return &countingNotifier{lock: new(sync.Mutex)}
+}
+
+func (c *countingNotifier) String() string {
+	return "counter"
+}
+
+func (c *countingNotifier) Notify(n *notification) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.sent = append(c.sent, n)
+	return nil
+}
+
+func (c *countingNotifier) results() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	results := []string{}
+	for _, n := range c.sent {
+		results = append(results, n.Result)
+	}
+	return results
+}
+
+// newTestService returns the service with the history in a temp dir, and the
+// func to remove it
+func newTestService(t *testing.T, jobs ...*JobConfig) (*Service, func()) {
+	dir, err := ioutil.TempDir("", "cron2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, job := range jobs {
+		if err := job.validate(); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+
+	service, err := newService(&Config{Jobs: jobs, History: &HistoryConfig{Path: dir}}, "")
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return service, func() { os.RemoveAll(dir) }
+}
+
+// newRetryJob returns the failing job that is retried after a long delay
+func newRetryJob(notifier Notifier) *JobConfig {
+	return &JobConfig{
+		Name:    "backup",
+		Spec:    "@every 1h",
+		Shell:   "sh",
+		Command: "exit 3",
+		Retry:   &RetryConfig{Attempts: 3, DelayString: "1h"},
+		Notify:  &NotifyConfig{Notifiers: []Notifier{notifier}},
+	}
+}
+
+// startTestRun runs the job in background until it waits for the retry.
+// Returned channel is closed when the run returns.
+func startTestRun(t *testing.T, service *Service, config *JobConfig) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Job{config: config, service: service, trigger: triggerSocket}.Run()
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(service.history.list(config.Name, 0)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("first attempt has not finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return done
+}
+
+// waitTestRun waits for the run to return
+func waitTestRun(t *testing.T, done <-chan struct{}) {
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run has not returned")
+	}
+}
+
+func TestRetryCancelledNotifies(t *testing.T) {
+	notifier := newCountingNotifier()
+	config := newRetryJob(notifier)
+
+	service, cleanup := newTestService(t, config)
+	defer cleanup()
+
+	done := startTestRun(t, service, config)
+
+	// Failure is held off until the retry
+	if sent := notifier.results(); len(sent) != 0 {
+		t.Fatalf("notifications sent before retry: %v", sent)
+	}
+
+	service.state.cancel(config.Name, resultCancelled)
+	waitTestRun(t, done)
+
+	sent := notifier.results()
+	if len(sent) != 1 || sent[0] != resultFailure {
+		t.Fatalf("notifications sent: %v, expected one failure", sent)
+	}
+}
+
+func TestRetryShutdownNotifies(t *testing.T) {
+	notifier := newCountingNotifier()
+	config := newRetryJob(notifier)
+
+	service, cleanup := newTestService(t, config)
+	defer cleanup()
+
+	service.scheduler.Start()
+	done := startTestRun(t, service, config)
+
+	// Interrupted retry is the final attempt on shutdown
+	service.stop()
+	waitTestRun(t, done)
+
+	sent := notifier.results()
+	if len(sent) != 1 || sent[0] != resultFailure {
+		t.Fatalf("notifications sent: %v, expected one failure", sent)
+	}
+
+	// Notifications are saved in the run record
+	history, err := newHistoryStore(service.config.History)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs := history.list(config.Name, 0)
+	if len(runs) != 1 || len(runs[0].Notifications) != 1 || !runs[0].Notifications[0].Success {
+		t.Fatalf("saved runs: %v", runs)
+	}
+}
@@ -1,28 +1,19 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
-	"net"
 )
 
 func listCurrentJobs(socketPath string) error {
-	conn, err := net.Dial("unix", socketPath)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
+	_, err := sendRequest(socketPath, &request{Command: cmdList}, func(data json.RawMessage) error {
+		status := &jobStatus{}
+		if err := json.Unmarshal(data, status); err != nil {
+			return err
+		}
 
-	if _, err := conn.Write([]byte("list")); err != nil {
-		return err
-	}
-
-	buff := make([]byte, 1024)
-
-	n, err := conn.Read(buff)
-	if err != nil {
-		return err
-	}
-
-	fmt.Println(string(buff[0:n]))
-	return nil
+		fmt.Println(status)
+		return nil
+	})
+	return err
 }
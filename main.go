@@ -12,6 +12,7 @@ var (
 	triggerName  string
 	listJobs     bool
 	reload       bool
+	historyName  string
 )
 
 func main() {
@@ -21,6 +22,7 @@ func main() {
 	flag.StringVar(&triggerName, "trigger", "", "Trigger a job")
 	flag.BoolVar(&listJobs, "list", false, "Show all jobs")
 	flag.BoolVar(&reload, "reload", false, "Reload config")
+	flag.StringVar(&historyName, "history", "", "Show run history of a job")
 	flag.Parse()
 
 	if reload {
@@ -38,6 +40,14 @@ func main() {
 		return
 	}
 
+	// Show recent runs of a job
+	if historyName != "" {
+		if err := showHistory(socketPath, historyName); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Show all configured jobs
 	if listJobs {
 		if err := listCurrentJobs(socketPath); err != nil {
@@ -60,20 +70,34 @@ func main() {
 		return
 	}
 
-	service, err := newService(config)
+	service, err := newService(config, configPath)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	go startFilewatcher(service, configPath)
 
+	listenerDone := make(chan struct{})
 	go func() {
+		defer close(listenerDone)
 		if err := startListener(service, socketPath); err != nil {
 			log.Fatal(err)
 		}
 	}()
 
+	// Start optional HTTP API and dashboard
+	if config.HTTP != nil {
+		go func() {
+			if err := startHTTPServer(service, config.HTTP); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
 	if err := service.start(); err != nil {
 		log.Fatal(err)
 	}
+
+	// Wait for the socket to be removed
+	<-listenerDone
 }
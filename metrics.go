@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds of job duration histogram buckets, in seconds
+var durationBuckets = []float64{1, 5, 15, 30, 60, 300, 900, 1800, 3600, 7200, 21600}
+
+// jobMetrics represents execution metrics of a single job
+type jobMetrics struct {
+	runs          uint64
+	successes     uint64
+	failures      uint64
+	timeouts      uint64
+	skipped       uint64
+	buckets       []uint64 // Counts per duration bucket, not cumulative
+	durationSum   float64
+	durationCount uint64
+}
+
+// metricsRegistry collects job execution metrics and exposes them in the
+// Prometheus text format
+type metricsRegistry struct {
+	lock         *sync.Mutex
+	jobs         map[string]*jobMetrics
+	lastReload   time.Time
+	reloadResult bool
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		lock: new(sync.Mutex),
+		jobs: map[string]*jobMetrics{},
+	}
+}
+
+// fetch returns metrics of the job, must be called with lock held
+func (m *metricsRegistry) fetch(name string) *jobMetrics {
+	metrics := m.jobs[name]
+	if metrics == nil {
+		metrics = &jobMetrics{buckets: make([]uint64, len(durationBuckets))}
+		m.jobs[name] = metrics
+	}
+	return metrics
+}
+
+// observe records the result of the job run
+func (m *metricsRegistry) observe(j *Job) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	metrics := m.fetch(j.config.Name)
+
+	if j.result == resultSkipped {
+		metrics.skipped++
+		return
+	}
+
+	metrics.runs++
+	if j.success {
+		metrics.successes++
+	} else {
+		metrics.failures++
+	}
+	if j.timedOut {
+		metrics.timeouts++
+	}
+
+	seconds := j.duration.Seconds()
+	metrics.durationSum += seconds
+	metrics.durationCount++
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			metrics.buckets[i]++
+			break
+		}
+	}
+}
+
+// reloaded records the time and result of the config reload
+func (m *metricsRegistry) reloaded(success bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.lastReload = time.Now()
+	m.reloadResult = success
+}
+
+// write renders all metrics in the Prometheus text format
+func (m *metricsRegistry) write(out io.Writer, service *Service) error {
+	w := bufio.NewWriter(out)
+	statuses := service.jobStatuses()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	names := make([]string, 0, len(m.jobs))
+	for name := range m.jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	counters := []struct {
+		name  string
+		help  string
+		value func(*jobMetrics) uint64
+	}{
+		{"cron2_job_runs_total", "Total number of job runs.", func(j *jobMetrics) uint64 { return j.runs }},
+		{"cron2_job_successes_total", "Total number of successful job runs.", func(j *jobMetrics) uint64 { return j.successes }},
+		{"cron2_job_failures_total", "Total number of failed job runs.", func(j *jobMetrics) uint64 { return j.failures }},
+		{"cron2_job_timeouts_total", "Total number of timed out job runs.", func(j *jobMetrics) uint64 { return j.timeouts }},
+		{"cron2_job_skipped_total", "Total number of skipped job runs.", func(j *jobMetrics) uint64 { return j.skipped }},
+	}
+	for _, c := range counters {
+		writeHeader(w, c.name, c.help, "counter")
+		for _, name := range names {
+			fmt.Fprintf(w, "%s{job=%s} %d\n", c.name, quoteLabel(name), c.value(m.jobs[name]))
+		}
+	}
+
+	writeHeader(w, "cron2_job_duration_seconds", "Duration of job runs.", "histogram")
+	for _, name := range names {
+		metrics := m.jobs[name]
+		label := quoteLabel(name)
+
+		var cumulative uint64
+		for i, bound := range durationBuckets {
+			cumulative += metrics.buckets[i]
+			fmt.Fprintf(w, "cron2_job_duration_seconds_bucket{job=%s,le=\"%g\"} %d\n", label, bound, cumulative)
+		}
+		fmt.Fprintf(w, "cron2_job_duration_seconds_bucket{job=%s,le=\"+Inf\"} %d\n", label, metrics.durationCount)
+		fmt.Fprintf(w, "cron2_job_duration_seconds_sum{job=%s} %g\n", label, metrics.durationSum)
+		fmt.Fprintf(w, "cron2_job_duration_seconds_count{job=%s} %d\n", label, metrics.durationCount)
+	}
+
+	writeHeader(w, "cron2_job_last_success_timestamp_seconds", "Time of the last successful job run.", "gauge")
+	for _, status := range statuses {
+		if !status.LastSuccessAt.IsZero() {
+			fmt.Fprintf(w, "cron2_job_last_success_timestamp_seconds{job=%s} %d\n", quoteLabel(status.Name), status.LastSuccessAt.Unix())
+		}
+	}
+
+	writeHeader(w, "cron2_job_running", "Number of currently running job instances.", "gauge")
+	for _, status := range statuses {
+		fmt.Fprintf(w, "cron2_job_running{job=%s} %d\n", quoteLabel(status.Name), status.Running)
+	}
+
+	active := 0
+	for _, status := range statuses {
+		if status.State == "active" {
+			active++
+		}
+	}
+	writeHeader(w, "cron2_jobs", "Number of configured jobs.", "gauge")
+	fmt.Fprintf(w, "cron2_jobs{state=\"active\"} %d\n", active)
+	fmt.Fprintf(w, "cron2_jobs{state=\"inactive\"} %d\n", len(statuses)-active)
+
+	if !m.lastReload.IsZero() {
+		result := 0
+		if m.reloadResult {
+			result = 1
+		}
+		writeHeader(w, "cron2_config_last_reload_timestamp_seconds", "Time of the last config reload.", "gauge")
+		fmt.Fprintf(w, "cron2_config_last_reload_timestamp_seconds %d\n", m.lastReload.Unix())
+		writeHeader(w, "cron2_config_last_reload_success", "Whether the last config reload was successful.", "gauge")
+		fmt.Fprintf(w, "cron2_config_last_reload_success %d\n", result)
+	}
+
+	return w.Flush()
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// labelReplacer escapes label values according to the text format
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(value string) string {
+	return `"` + labelReplacer.Replace(value) + `"`
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/hashicorp/hcl/hcl/ast"
+)
+
+// Notifier delivers run notifications to a single target
+type Notifier interface {
+	// String returns the target description used in logs
+	String() string
+
+	// Notify sends the notification to the target
+	Notify(n *notification) error
+}
+
+// notifierType describes the notifier config block
+type notifierType struct {
+	keys   []string                                              // Allowed keys in the block
+	create func(node ast.Node, job *JobConfig) (Notifier, error) // Creates notifier from the block
+}
+
+// notifierTypes contains all registered notifier types by block name
+var notifierTypes = map[string]*notifierType{}
+
+// registerNotifier makes the notifier type available in the "notify" block
+func registerNotifier(kind string, keys []string, create func(node ast.Node, job *JobConfig) (Notifier, error)) {
+	if _, ok := notifierTypes[kind]; ok {
+		panic("notifier is already registered: " + kind)
+	}
+	notifierTypes[kind] = &notifierType{keys: keys, create: create}
+}
+
+// outputOptionKeys lists keys of the output options shared by notifiers
+var outputOptionKeys = []string{
+	"include_output",
+	"output_lines",
+	"output_bytes",
+}
+
+// notifierKinds returns the list of registered notifier types
+func notifierKinds() []string {
+	kinds := make([]string, 0, len(notifierTypes))
+	for kind := range notifierTypes {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// notification represents the run result sent to notifiers
+type notification struct {
+	ID          int64
+	Job         string
+	Trigger     string
+	Result      string
+	Success     bool
+	ExitStatus  int
+	StartedAt   time.Time
+	Duration    time.Duration
+	Attempt     int
+	MaxAttempts int
+	Message     string
+	Config      *JobConfig
+	NextRun     *time.Time
+	History     *historySummary
+
+	output *tailBuffer
+	redact []*regexp.Regexp
+}
+
+// notifyResult represents the delivery result of a single notifier
+type notifyResult struct {
+	Target  string `json:"target"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Version of the JSON notification schema
+const notifyPayloadVersion = 1
+
+// notifyPayload represents the JSON document sent by webhook and exec
+// notifiers. Changes of the fields must be reflected in the README.
+type notifyPayload struct {
+	Version         int        `json:"version"`
+	ID              int64      `json:"id"`
+	Job             string     `json:"job"`
+	Trigger         string     `json:"trigger"`
+	Result          string     `json:"result"`
+	Success         bool       `json:"success"`
+	ExitStatus      int        `json:"exit_status"`
+	StartedAt       time.Time  `json:"started_at"`
+	FinishedAt      time.Time  `json:"finished_at"`
+	DurationSeconds float64    `json:"duration_seconds"`
+	Attempt         int        `json:"attempt"`
+	MaxAttempts     int        `json:"max_attempts"`
+	NextRun         *time.Time `json:"next_run"`
+	Host            string     `json:"host"`
+	Message         string     `json:"message"`
+	Output          *string    `json:"output"`
+}
+
+// payload returns the notification as JSON document
+func (n *notification) payload(tmpl *template.Template, opts outputOptions) *notifyPayload {
+	data := n.data(opts)
+
+	payload := &notifyPayload{
+		Version:         notifyPayloadVersion,
+		ID:              n.ID,
+		Job:             n.Job,
+		Trigger:         n.Trigger,
+		Result:          n.Result,
+		Success:         n.Success,
+		ExitStatus:      n.ExitStatus,
+		StartedAt:       n.StartedAt.UTC(),
+		FinishedAt:      n.StartedAt.Add(n.Duration).UTC(),
+		DurationSeconds: n.Duration.Seconds(),
+		Attempt:         n.Attempt,
+		MaxAttempts:     n.MaxAttempts,
+		Host:            data.Host,
+		Message:         n.text(tmpl, opts),
+	}
+	if n.NextRun != nil {
+		next := n.NextRun.UTC()
+		payload.NextRun = &next
+	}
+	if data.Output != "" {
+		payload.Output = &data.Output
+	}
+	return payload
+}
+
+// outputOptions represents settings of the output attached to notifications
+type outputOptions struct {
+	IncludeOutput bool `hcl:"include_output"` // Attach output tail on failures
+	OutputLines   int  `hcl:"output_lines"`   // Number of output lines to attach
+	OutputBytes   int  `hcl:"output_bytes"`   // Max size of the attached output
+}
+
+// messageData represents fields available in message templates
+type messageData struct {
+	Job         string          // Job name
+	Config      *JobConfig      // Job config
+	Result      string          // Run result: success, failure, etc
+	Success     bool            // True if the run has succeeded
+	ExitStatus  int             // Exit status of the command
+	StartedAt   time.Time       // Run start time
+	Duration    time.Duration   // Run duration
+	Attempt     int             // Attempt number
+	MaxAttempts int             // Max number of attempts
+	NextRun     *time.Time      // Next scheduled run, if any
+	History     *historySummary // Results of the recent runs
+	Message     string          // Notification message
+	Host        string          // Hostname of the server
+	Output      string          // Redacted output tail, if enabled
+}
+
+// data returns the template fields of the notification. The message is
+// rendered from the job message template when it is set.
+func (n *notification) data(opts outputOptions) *messageData {
+	host, _ := os.Hostname()
+
+	data := &messageData{
+		Job:         n.Job,
+		Config:      n.Config,
+		Result:      n.Result,
+		Success:     n.Success,
+		ExitStatus:  n.ExitStatus,
+		StartedAt:   n.StartedAt,
+		Duration:    n.Duration,
+		Attempt:     n.Attempt,
+		MaxAttempts: n.MaxAttempts,
+		NextRun:     n.NextRun,
+		History:     n.History,
+		Message:     n.Message,
+		Host:        host,
+		Output:      n.outputTail(opts),
+	}
+
+	if notify := n.Config.Notify; notify != nil && notify.messageTemplate != nil {
+		data.Message = n.execute(notify.messageTemplate, data)
+	}
+
+	return data
+}
+
+// text returns the message rendered with the notifier template, or the job
+// message when the notifier has no template
+func (n *notification) text(tmpl *template.Template, opts outputOptions) string {
+	data := n.data(opts)
+	if tmpl == nil {
+		return data.Message
+	}
+	return n.execute(tmpl, data)
+}
+
+// execute renders the template. Falls back to the default message when the
+// template fails, so that the alert is never lost.
+func (n *notification) execute(tmpl *template.Template, data *messageData) string {
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, data); err != nil {
+		log.Printf("[%s] cant render %s template: %v\n", n.Job, tmpl.Name(), err)
+		return n.Message
+	}
+	return buf.String()
+}
+
+// parseMessageTemplate parses the message template and renders it with sample
+// data of the job to catch invalid fields at config load
+func parseMessageTemplate(name string, text string, job *JobConfig) (*template.Template, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	sample := &messageData{
+		Job:         job.Name,
+		Config:      job,
+		Result:      resultFailure,
+		ExitStatus:  1,
+		StartedAt:   now,
+		Attempt:     1,
+		MaxAttempts: 1,
+		NextRun:     &now,
+		History:     &historySummary{Runs: 1, Failures: 1, ConsecutiveFailures: 1},
+		Message:     fmt.Sprintf("Job %q has failed", job.Name),
+	}
+	if err := tmpl.Execute(ioutil.Discard, sample); err != nil {
+		return nil, err
+	}
+
+	return tmpl, nil
+}
+
+// newNotification returns a notification for the job run
+func newNotification(j *Job) *notification {
+	n := &notification{
+		ID:          j.id,
+		Job:         j.config.Name,
+		Trigger:     j.trigger,
+		Result:      j.result,
+		Success:     j.success,
+		ExitStatus:  j.exitStatus,
+		StartedAt:   j.startedAt,
+		Duration:    j.duration,
+		Attempt:     j.attempt,
+		MaxAttempts: j.maxAttempts(),
+		Config:      j.config,
+		output:      j.output,
+	}
+	if j.config.Notify != nil {
+		n.redact = j.config.Notify.redactPatterns
+	}
+
+	if next, err := j.config.nextRun(); err == nil && !j.config.Disabled {
+		n.NextRun = &next
+	}
+
+	// Recent runs including the current one
+	runs := j.service.history.list(j.config.Name, historySummaryRuns)
+	if j.id > 0 {
+		runs = append([]*Run{j.record()}, runs...)
+	}
+	n.History = summarizeRuns(runs)
+	if last := j.service.state.get(j.config.Name).LastSuccessAt; !last.IsZero() {
+		n.History.LastSuccessAt = last
+	}
+
+	switch j.result {
+	case resultSuccess:
+		n.Message = fmt.Sprintf("Job %q has finished. Duration: %v", n.Job, n.Duration)
+	case resultSkipped:
+		n.Message = fmt.Sprintf("Job %q run was skipped: max number of instances is running", n.Job)
+	case resultReplaced:
+		n.Message = fmt.Sprintf("Job %q run was replaced by a newer run. Duration: %v", n.Job, n.Duration)
+	case resultCancelled:
+		n.Message = fmt.Sprintf("Job %q run was cancelled on config reload. Duration: %v", n.Job, n.Duration)
+	case resultTimeout:
+		n.Message = fmt.Sprintf("Job %q has timed out after %v", n.Job, j.config.Timeout)
+	case resultMissed:
+		n.Message = fmt.Sprintf("Job %q has not succeeded within %v", n.Job, j.config.ExpectSuccessWithin)
+		if last := n.History.LastSuccessAt; !last.IsZero() {
+			n.Message += fmt.Sprintf(". Last success: %s", last.Format(time.RFC3339))
+		} else {
+			n.Message += ". No successful runs found"
+		}
+		if j.config.Disabled {
+			n.Message += ". Job is disabled"
+		}
+	default:
+		n.Message = fmt.Sprintf("Job %q has failed with status code: %v. Duration: %v", n.Job, n.ExitStatus, n.Duration)
+	}
+	if n.MaxAttempts > 1 && n.Attempt > 0 {
+		n.Message += fmt.Sprintf(". Attempt %d of %d", n.Attempt, n.MaxAttempts)
+	}
+
+	return n
+}
+
+// outputTail returns the redacted output of the failed run
+func (n *notification) outputTail(opts outputOptions) string {
+	if !opts.IncludeOutput || n.Success || n.output == nil {
+		return ""
+	}
+
+	lines := opts.OutputLines
+	if lines == 0 {
+		lines = defaultOutputLines
+	}
+	return redact(n.output.tail(lines, opts.OutputBytes), n.redact)
+}
+
+// sendNotifications sends alerts to all notification targets
+func sendNotifications(j *Job) {
+	notify := j.config.Notify
+	if notify == nil || len(notify.Notifiers) == 0 {
+		return
+	}
+	if !j.service.state.alert(j) {
+		return
+	}
+
+	n := newNotification(j)
+
+	log.Printf("[%s] sending notifications\n", j.config.Name)
+	defer log.Printf("[%s] done sending notifications\n", j.config.Name)
+
+	results := make([]notifyResult, len(notify.Notifiers))
+	wg := &sync.WaitGroup{}
+
+	for i, notifier := range notify.Notifiers {
+		wg.Add(1)
+
+		go func(i int, notifier Notifier) {
+			defer wg.Done()
+
+			results[i] = notifyResult{Target: notifier.String(), Success: true}
+
+			if err := notifier.Notify(n); err != nil {
+				results[i].Success = false
+				results[i].Error = err.Error()
+				log.Printf("[%s] failed to send %v: %v\n", j.config.Name, notifier, err)
+				return
+			}
+
+			log.Printf("[%s] sent notification to %v\n", j.config.Name, notifier)
+		}(i, notifier)
+	}
+
+	wg.Wait()
+	j.notifications = results
+}
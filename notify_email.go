@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+)
+
+const (
+	emailTLSStartTLS = "starttls" // Upgrade plain connection, required by default
+	emailTLSImplicit = "implicit" // Connect over TLS, usually on port 465
+	emailTLSNone     = "none"     // Plain text connection, for local relays
+
+	defaultEmailSubject = `[cron2] {{.Job}}: {{.Result}}`
+	defaultEmailBody    = `{{.Message}}
+
+Host: {{.Host}}
+Started at: {{.StartedAt.Format "2006-01-02T15:04:05Z07:00"}}
+Exit status: {{.ExitStatus}}
+Duration: {{.Duration}}
+{{if .Output}}
+Output:
+
+{{.Output}}
+{{end}}`
+)
+
+func init() {
+	keys := []string{"host", "port", "tls", "username", "password", "from", "to", "cc", "subject", "body"}
+	registerNotifier("email", append(keys, outputOptionKeys...), newEmailNotifier)
+}
+
+// EmailNotifier sends notifications over SMTP
+type EmailNotifier struct {
+	Host          string   `hcl:"host"`     // SMTP server host
+	Port          int      `hcl:"port"`     // SMTP server port
+	TLS           string   `hcl:"tls"`      // One of "starttls", "implicit", "none"
+	Username      string   `hcl:"username"` // Auth username (optional)
+	Password      string   `hcl:"password"` // Auth password (optional)
+	From          string   `hcl:"from"`     // Sender address
+	To            []string `hcl:"to"`       // Recipients
+	Cc            []string `hcl:"cc"`       // Carbon copy recipients
+	Subject       string   `hcl:"subject"`  // Subject template
+	Body          string   `hcl:"body"`     // Body template
+	outputOptions `hcl:",squash"`
+
+	// Computed fields
+	subjectTemplate *template.Template
+	bodyTemplate    *template.Template
+}
+
+func newEmailNotifier(node ast.Node, job *JobConfig) (Notifier, error) {
+	email := new(EmailNotifier)
+	if err := hcl.DecodeObject(email, node); err != nil {
+		return nil, err
+	}
+
+	if email.Host == "" {
+		return nil, errors.New("host is required")
+	}
+	if email.From == "" {
+		return nil, errors.New("from is required")
+	}
+	if len(email.To) == 0 {
+		return nil, errors.New("to is required")
+	}
+
+	switch email.TLS {
+	case "":
+		email.TLS = emailTLSStartTLS
+	case emailTLSStartTLS, emailTLSImplicit, emailTLSNone:
+	default:
+		return nil, &fieldError{field: "tls", err: fmt.Errorf("%q", email.TLS)}
+	}
+
+	if email.Port == 0 {
+		email.Port = 587
+		if email.TLS == emailTLSImplicit {
+			email.Port = 465
+		}
+	}
+
+	if email.Subject == "" {
+		email.Subject = defaultEmailSubject
+	}
+	if email.Body == "" {
+		email.Body = defaultEmailBody
+	}
+
+	var err error
+	if email.subjectTemplate, err = parseMessageTemplate("email subject", email.Subject, job); err != nil {
+		return nil, &fieldError{field: "subject", err: err}
+	}
+	if email.bodyTemplate, err = parseMessageTemplate("email body", email.Body, job); err != nil {
+		return nil, &fieldError{field: "body", err: err}
+	}
+
+	return email, nil
+}
+
+func (e *EmailNotifier) String() string {
+	return "email " + strings.Join(e.To, ", ")
+}
+
+// Notify sends the notification email
+func (e *EmailNotifier) Notify(n *notification) error {
+	msg, err := e.message(n)
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+	dialer := &net.Dialer{Timeout: notifyTimeout}
+	tlsConfig := &tls.Config{ServerName: e.Host}
+
+	var conn net.Conn
+	if e.TLS == emailTLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(notifyTimeout))
+
+	client, err := smtp.NewClient(conn, e.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if e.TLS == emailTLSStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("server does not support STARTTLS")
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	if e.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", e.Username, e.Password, e.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(e.From); err != nil {
+		return err
+	}
+	for _, rcpt := range append(append([]string{}, e.To...), e.Cc...) {
+		if err := client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// message renders the email with headers
+func (e *EmailNotifier) message(n *notification) ([]byte, error) {
+	data := n.data(e.outputOptions)
+
+	subject := &bytes.Buffer{}
+	if err := e.subjectTemplate.Execute(subject, data); err != nil {
+		return nil, err
+	}
+	body := &bytes.Buffer{}
+	if err := e.bodyTemplate.Execute(body, data); err != nil {
+		return nil, err
+	}
+
+	msg := &bytes.Buffer{}
+	fmt.Fprintf(msg, "From: %s\r\n", e.From)
+	fmt.Fprintf(msg, "To: %s\r\n", strings.Join(e.To, ", "))
+	if len(e.Cc) > 0 {
+		fmt.Fprintf(msg, "Cc: %s\r\n", strings.Join(e.Cc, ", "))
+	}
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject.String())))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	qp := quotedprintable.NewWriter(msg)
+	if _, err := qp.Write(body.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+
+	return msg.Bytes(), nil
+}
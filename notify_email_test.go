@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+)
+
+// smtpMessage represents the email received by the fake SMTP server
+type smtpMessage struct {
+	from string
+	rcpt []string
+	data string
+}
+
+// startFakeSMTP starts the SMTP server that accepts a single message
+func startFakeSMTP(t *testing.T, extensions ...string) (int, <-chan *smtpMessage) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := make(chan *smtpMessage, 1)
+	go func() {
+		defer listener.Close()
+
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		msg := &smtpMessage{}
+
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			cmd := strings.ToUpper(line)
+
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"):
+				lines := append([]string{"localhost"}, extensions...)
+				for i, ext := range lines {
+					sep := "-"
+					if i == len(lines)-1 {
+						sep = " "
+					}
+					reply("250" + sep + ext)
+				}
+			case strings.HasPrefix(cmd, "MAIL FROM:"):
+				msg.from = strings.Trim(line[len("MAIL FROM:"):], "<> ")
+				reply("250 OK")
+			case strings.HasPrefix(cmd, "RCPT TO:"):
+				msg.rcpt = append(msg.rcpt, strings.Trim(line[len("RCPT TO:"):], "<> "))
+				reply("250 OK")
+			case cmd == "DATA":
+				reply("354 Go ahead")
+				data := &strings.Builder{}
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data.WriteString(strings.TrimPrefix(line, "."))
+				}
+				msg.data = data.String()
+				reply("250 OK")
+			case cmd == "QUIT":
+				reply("221 Bye")
+				messages <- msg
+				return
+			default:
+				reply("502 Not implemented")
+			}
+		}
+	}()
+
+	return listener.Addr().(*net.TCPAddr).Port, messages
+}
+
+// newTestEmailNotifier creates the notifier from the HCL block
+func newTestEmailNotifier(t *testing.T, src string, job *JobConfig) *EmailNotifier {
+	file, err := hcl.Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := file.Node.(*ast.ObjectList).Filter("email").Items[0].Val
+
+	notifier, err := newEmailNotifier(node, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return notifier.(*EmailNotifier)
+}
+
+func testEmailNotification(job *JobConfig) *notification {
+	output := newTailBuffer(tailBufferSize)
+	output.Write([]byte("connecting\nconnection refused\n"))
+
+	return &notification{
+		ID:         7,
+		Job:        job.Name,
+		Result:     resultFailure,
+		ExitStatus: 3,
+		StartedAt:  time.Now(),
+		Duration:   2 * time.Second,
+		Message:    `Job "backup" has failed`,
+		Config:     job,
+		output:     output,
+	}
+}
+
+func TestEmailNotifier(t *testing.T) {
+	port, messages := startFakeSMTP(t)
+	job := &JobConfig{Name: "backup"}
+
+	email := newTestEmailNotifier(t, `
+email {
+  host = "127.0.0.1"
+  port = `+strconv.Itoa(port)+`
+  tls = "none"
+  from = "cron2@example.com"
+  to = ["ops@example.com", "dev@example.com"]
+  cc = ["team@example.com"]
+  subject = "{{.Job}} {{.Result}} ({{.ExitStatus}})"
+  body = "{{.Message}} after {{.Duration}}\n{{.Output}}"
+  include_output = true
+}`, job)
+
+	if err := email.Notify(testEmailNotification(job)); err != nil {
+		t.Fatal(err)
+	}
+
+	var msg *smtpMessage
+	select {
+	case msg = <-messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message is not received")
+	}
+
+	if msg.from != "cron2@example.com" {
+		t.Errorf("envelope from = %q", msg.from)
+	}
+	if rcpt := strings.Join(msg.rcpt, ","); rcpt != "ops@example.com,dev@example.com,team@example.com" {
+		t.Errorf("envelope recipients = %q", rcpt)
+	}
+
+	parsed, err := mail.ReadMessage(strings.NewReader(msg.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers := map[string]string{
+		"From":         "cron2@example.com",
+		"To":           "ops@example.com, dev@example.com",
+		"Cc":           "team@example.com",
+		"Subject":      "backup failure (3)",
+		"Content-Type": "text/plain; charset=utf-8",
+	}
+	for key, expected := range headers {
+		if val := parsed.Header.Get(key); val != expected {
+			t.Errorf("header %s = %q, expected %q", key, val, expected)
+		}
+	}
+	if parsed.Header.Get("Date") == "" {
+		t.Error("date header is missing")
+	}
+
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(parsed.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Job \"backup\" has failed after 2s\r\nconnecting\r\nconnection refused"
+	if got := strings.TrimSpace(string(body)); got != expected {
+		t.Errorf("body = %q, expected %q", got, expected)
+	}
+}
+
+func TestEmailNotifierRequiresStartTLS(t *testing.T) {
+	port, _ := startFakeSMTP(t)
+	job := &JobConfig{Name: "backup"}
+
+	email := newTestEmailNotifier(t, `
+email {
+  host = "127.0.0.1"
+  port = `+strconv.Itoa(port)+`
+  from = "cron2@example.com"
+  to = ["ops@example.com"]
+}`, job)
+
+	err := email.Notify(testEmailNotification(job))
+	if err == nil || err.Error() != "server does not support STARTTLS" {
+		t.Fatalf("expected STARTTLS error, got: %v", err)
+	}
+}
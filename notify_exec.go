@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+)
+
+// Max size of the notifier command output kept for error messages
+const execNotifierOutputSize = 4 * 1024
+
+func init() {
+	keys := []string{"command", "args", "timeout", "user", "env", "message"}
+	registerNotifier("exec", append(keys, outputOptionKeys...), newExecNotifier)
+}
+
+// ExecNotifier runs a local command with the run result as JSON on stdin
+type ExecNotifier struct {
+	Command       string            `hcl:"command"` // Command with arguments
+	Args          []string          `hcl:"args"`    // Command as a list of arguments
+	TimeoutString string            `hcl:"timeout"` // Max execution time
+	User          string            `hcl:"user"`    // Run as user
+	Environment   map[string]string `hcl:"env"`     // Extra env vars
+	Message       string            `hcl:"message"` // Message template
+	outputOptions `hcl:",squash"`
+
+	// Computed fields
+	Timeout         time.Duration `hcl:"-"`
+	argv            []string
+	credential      *syscall.Credential
+	messageTemplate *template.Template
+}
+
+func newExecNotifier(node ast.Node, job *JobConfig) (Notifier, error) {
+	e := new(ExecNotifier)
+	if err := hcl.DecodeObject(e, node); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case e.Command != "" && len(e.Args) > 0:
+		return nil, errors.New("command and args can not be used together")
+	case len(e.Args) > 0:
+		e.argv = e.Args
+	case e.Command != "":
+		argv, err := splitWords(e.Command, os.Getenv)
+		if err != nil {
+			return nil, &fieldError{field: "command", err: err}
+		}
+		e.argv = argv
+	}
+	if len(e.argv) == 0 {
+		return nil, errors.New("command is required")
+	}
+
+	e.Timeout = notifyTimeout
+	if e.TimeoutString != "" {
+		dur, err := time.ParseDuration(e.TimeoutString)
+		if err != nil {
+			return nil, &fieldError{field: "timeout", err: err}
+		}
+		e.Timeout = dur
+	}
+
+	if e.User != "" {
+		usr, err := user.Lookup(e.User)
+		if err != nil {
+			return nil, &fieldError{field: "user", err: err}
+		}
+		uid, _ := strconv.Atoi(usr.Uid)
+		gid, _ := strconv.Atoi(usr.Gid)
+		e.credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	}
+
+	if e.Message != "" {
+		tmpl, err := parseMessageTemplate("exec message", e.Message, job)
+		if err != nil {
+			return nil, &fieldError{field: "message", err: err}
+		}
+		e.messageTemplate = tmpl
+	}
+
+	return e, nil
+}
+
+func (e *ExecNotifier) String() string {
+	return "exec " + e.argv[0]
+}
+
+// Notify runs the command and waits for it to finish
+func (e *ExecNotifier) Notify(n *notification) error {
+	payload := n.payload(e.messageTemplate, e.outputOptions)
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	output := newTailBuffer(execNotifierOutputSize)
+
+	cmd := exec.Command(e.argv[0], e.argv[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.Env = append(os.Environ(), e.env(payload)...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: e.credential}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+	case <-time.After(e.Timeout):
+		// Kill the whole process group, the command may run a script
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		err = fmt.Errorf("timed out after %v", e.Timeout)
+	}
+
+	if err != nil {
+		if out := strings.TrimSpace(output.tail(defaultOutputLines, 0)); out != "" {
+			return fmt.Errorf("%v: %s", err, out)
+		}
+		return err
+	}
+	return nil
+}
+
+// env returns CRON2_* environment variables of the notification, followed by
+// the configured ones
+func (e *ExecNotifier) env(p *notifyPayload) []string {
+	env := []string{
+		"CRON2_JOB=" + p.Job,
+		"CRON2_RUN_ID=" + strconv.FormatInt(p.ID, 10),
+		"CRON2_TRIGGER=" + p.Trigger,
+		"CRON2_RESULT=" + p.Result,
+		"CRON2_SUCCESS=" + strconv.FormatBool(p.Success),
+		"CRON2_EXIT_STATUS=" + strconv.Itoa(p.ExitStatus),
+		"CRON2_STARTED_AT=" + p.StartedAt.Format(time.RFC3339),
+		"CRON2_FINISHED_AT=" + p.FinishedAt.Format(time.RFC3339),
+		"CRON2_DURATION=" + strconv.FormatFloat(p.DurationSeconds, 'f', -1, 64),
+		"CRON2_ATTEMPT=" + strconv.Itoa(p.Attempt),
+		"CRON2_MAX_ATTEMPTS=" + strconv.Itoa(p.MaxAttempts),
+		"CRON2_HOST=" + p.Host,
+		"CRON2_MESSAGE=" + p.Message,
+	}
+	for key, val := range e.Environment {
+		env = append(env, key+"="+val)
+	}
+	return env
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	// Max time to deliver a single notification
+	notifyTimeout = 15 * time.Second
+
+	// Max number of delivery attempts for HTTP notifiers
+	notifyHTTPAttempts = 3
+
+	// Delay before the first retry, doubled for every next attempt
+	notifyHTTPRetryDelay = time.Second
+)
+
+// notifyClient is the shared HTTP client for all notifiers
+var notifyClient = &http.Client{
+	Timeout: notifyTimeout,
+}
+
+// sendHTTP performs the request, retrying on network errors and server
+// errors. The request is created for every attempt.
+func sendHTTP(newRequest func() (*http.Request, error)) error {
+	var lastErr error
+	delay := notifyHTTPRetryDelay
+
+	for attempt := 1; attempt <= notifyHTTPAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+
+		req, err := newRequest()
+		if err != nil {
+			return err
+		}
+
+		resp, err := notifyClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+
+		if resp.StatusCode >= 500 {
+			lastErr = fmt.Errorf("server error: %s", resp.Status)
+			continue
+		}
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("request failed: %s", resp.Status)
+		}
+		return nil
+	}
+
+	return lastErr
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"text/template"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+)
+
+func init() {
+	registerNotifier("slack", append([]string{"url", "username", "channel", "message"}, outputOptionKeys...), newSlackNotifier)
+}
+
+// SlackNotifier posts the run result to the slack incoming webhook
+type SlackNotifier struct {
+	URL           string `hcl:"url"`
+	User          string `hcl:"username"`
+	Channel       string `hcl:"channel"`
+	Message       string `hcl:"message"` // Message template
+	outputOptions `hcl:",squash"`
+
+	// Computed fields
+	messageTemplate *template.Template
+}
+
+func newSlackNotifier(node ast.Node, job *JobConfig) (Notifier, error) {
+	slack := new(SlackNotifier)
+	if err := hcl.DecodeObject(slack, node); err != nil {
+		return nil, err
+	}
+	if slack.URL == "" {
+		return nil, errors.New("url is required")
+	}
+
+	if slack.Message != "" {
+		tmpl, err := parseMessageTemplate("slack message", slack.Message, job)
+		if err != nil {
+			return nil, &fieldError{field: "message", err: err}
+		}
+		slack.messageTemplate = tmpl
+	}
+
+	return slack, nil
+}
+
+func (s *SlackNotifier) String() string {
+	return "slack " + s.Channel
+}
+
+// Notify sends the message to slack
+func (s *SlackNotifier) Notify(n *notification) error {
+	// Output is attached as a code block unless the template includes it
+	text := n.text(s.messageTemplate, s.outputOptions)
+	if output := n.outputTail(s.outputOptions); output != "" && s.messageTemplate == nil {
+		text += "\n```\n" + output + "\n```"
+	}
+
+	payload := map[string]string{
+		"text":     text,
+		"username": s.User,
+		"channel":  s.Channel,
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	return sendHTTP(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+)
+
+const (
+	webhookFormatForm = "form" // URL encoded form, default
+	webhookFormatJSON = "json" // JSON document, see notifyPayload
+
+	// Default header with the payload signature
+	defaultSignatureHeader = "X-Cron2-Signature"
+)
+
+func init() {
+	keys := []string{
+		"url",
+		"message",
+		"format",
+		"method",
+		"headers",
+		"username",
+		"password",
+		"token",
+		"secret",
+		"signature_header",
+	}
+	registerNotifier("webhook", append(keys, outputOptionKeys...), newWebhookNotifier)
+}
+
+// WebhookNotifier sends HTTP request with the run details
+type WebhookNotifier struct {
+	URL             string            `hcl:"url"`
+	Message         string            `hcl:"message"`          // Message template
+	Format          string            `hcl:"format"`           // Payload format: "form" or "json"
+	Method          string            `hcl:"method"`           // HTTP method, POST by default
+	Headers         map[string]string `hcl:"headers"`          // Extra request headers
+	Username        string            `hcl:"username"`         // Basic auth username
+	Password        string            `hcl:"password"`         // Basic auth password
+	Token           string            `hcl:"token"`            // Bearer auth token
+	Secret          string            `hcl:"secret"`           // HMAC key to sign the payload with
+	SignatureHeader string            `hcl:"signature_header"` // Header with the payload signature
+	outputOptions   `hcl:",squash"`
+
+	// Computed fields
+	messageTemplate *template.Template
+}
+
+func newWebhookNotifier(node ast.Node, job *JobConfig) (Notifier, error) {
+	webhook := new(WebhookNotifier)
+	if err := hcl.DecodeObject(webhook, node); err != nil {
+		return nil, err
+	}
+	if webhook.URL == "" {
+		return nil, errors.New("url is required")
+	}
+
+	switch webhook.Format {
+	case "":
+		webhook.Format = webhookFormatForm
+	case webhookFormatForm, webhookFormatJSON:
+	default:
+		return nil, &fieldError{field: "format", err: fmt.Errorf("%q", webhook.Format)}
+	}
+
+	if webhook.Method == "" {
+		webhook.Method = http.MethodPost
+	}
+	webhook.Method = strings.ToUpper(webhook.Method)
+
+	if webhook.Token != "" && webhook.Username != "" {
+		return nil, errors.New("token and username can not be used together")
+	}
+	if webhook.SignatureHeader == "" {
+		webhook.SignatureHeader = defaultSignatureHeader
+	}
+
+	if webhook.Message != "" {
+		tmpl, err := parseMessageTemplate("webhook message", webhook.Message, job)
+		if err != nil {
+			return nil, &fieldError{field: "message", err: err}
+		}
+		webhook.messageTemplate = tmpl
+	}
+
+	return webhook, nil
+}
+
+func (w *WebhookNotifier) String() string {
+	return "webhook " + w.URL
+}
+
+// Notify sends the notification in the configured format
+func (w *WebhookNotifier) Notify(n *notification) error {
+	var body []byte
+	var contentType string
+	var err error
+
+	switch w.Format {
+	case webhookFormatJSON:
+		contentType = "application/json"
+		body, err = json.Marshal(n.payload(w.messageTemplate, w.outputOptions))
+		if err != nil {
+			return err
+		}
+	default:
+		contentType = "application/x-www-form-urlencoded"
+		body = []byte(w.form(n).Encode())
+	}
+
+	return sendHTTP(func() (*http.Request, error) {
+		req, err := http.NewRequest(w.Method, w.URL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", contentType)
+		for key, val := range w.Headers {
+			req.Header.Set(key, val)
+		}
+
+		switch {
+		case w.Token != "":
+			req.Header.Set("Authorization", "Bearer "+w.Token)
+		case w.Username != "":
+			req.SetBasicAuth(w.Username, w.Password)
+		}
+
+		if w.Secret != "" {
+			req.Header.Set(w.SignatureHeader, "sha256="+w.sign(body))
+		}
+		return req, nil
+	})
+}
+
+// form returns the notification as URL encoded form
+func (w *WebhookNotifier) form(n *notification) url.Values {
+	data := n.data(w.outputOptions)
+
+	form := url.Values{}
+	form.Add("job_name", n.Job)
+	form.Add("duration", fmt.Sprintf("%v", n.Duration))
+	form.Add("started_at", fmt.Sprintf("%v", n.StartedAt))
+	form.Add("success", fmt.Sprintf("%v", n.Success))
+	form.Add("result", n.Result)
+	form.Add("attempt", fmt.Sprintf("%v", n.Attempt))
+	form.Add("exit_status", fmt.Sprintf("%v", n.ExitStatus))
+	form.Add("message", n.text(w.messageTemplate, w.outputOptions))
+	if data.Output != "" {
+		form.Add("output", data.Output)
+	}
+	return form
+}
+
+// sign returns hex encoded HMAC-SHA256 of the body
+func (w *WebhookNotifier) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(w.Secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
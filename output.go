@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	// Time format of the run start time in output paths
+	outputTimeFormat = "20060102-150405"
+
+	// Time to wait for the output of the finished command to be closed
+	outputDrainTimeout = 5 * time.Second
+)
+
+// outputVars represents variables available in output path templates
+type outputVars struct {
+	Name      string // Job name
+	ID        string // Run ID
+	StartedAt string // Run start time
+	Attempt   string // Attempt number
+}
+
+// runOutput represents output destinations of a single run
+type runOutput struct {
+	stdout io.Writer
+	stderr io.Writer
+	path   string // Path to the output file, if any
+	files  []*os.File
+}
+
+// openRunOutput prepares output destinations for the job run. Without
+// output settings the run output goes to the service stdout and stderr.
+func openRunOutput(j *Job) (*runOutput, error) {
+	out := &runOutput{stdout: os.Stdout, stderr: os.Stderr}
+
+	config := j.config.Output
+	if config == nil {
+		out.capture(j.output)
+		return out, nil
+	}
+
+	vars := j.outputVars()
+
+	stdout, err := out.open(config.pathTemplate, vars)
+	if err != nil {
+		return nil, err
+	}
+	out.path = stdout.Name()
+	out.stdout = config.wrap(stdout)
+	out.stderr = out.stdout
+
+	if config.stderrTemplate != nil {
+		stderr, err := out.open(config.stderrTemplate, vars)
+		if err != nil {
+			out.Close()
+			return nil, err
+		}
+		out.stderr = config.wrap(stderr)
+	}
+
+	out.capture(j.output)
+	return out, nil
+}
+
+// capture copies the run output into the tail buffer
+func (o *runOutput) capture(tail *tailBuffer) {
+	if tail == nil {
+		return
+	}
+
+	merged := o.stdout == o.stderr
+	o.stdout = io.MultiWriter(o.stdout, tail)
+	if merged {
+		o.stderr = o.stdout
+	} else {
+		o.stderr = io.MultiWriter(o.stderr, tail)
+	}
+}
+
+// open creates the output file for the run
+func (o *runOutput) open(tmpl *template.Template, vars *outputVars) (*os.File, error) {
+	path, err := renderOutputPath(tmpl, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	o.files = append(o.files, f)
+
+	return f, nil
+}
+
+// Close closes all output files
+func (o *runOutput) Close() error {
+	var result error
+	for _, f := range o.files {
+		if err := f.Close(); err != nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// outputVars returns the template variables of the run
+func (j *Job) outputVars() *outputVars {
+	return &outputVars{
+		Name:      strings.Replace(j.config.Name, string(filepath.Separator), "_", -1),
+		ID:        fmt.Sprintf("%d", j.id),
+		StartedAt: j.startedAt.UTC().Format(outputTimeFormat),
+		Attempt:   fmt.Sprintf("%d", j.attempt),
+	}
+}
+
+// renderOutputPath returns the output path for the given variables
+func renderOutputPath(tmpl *template.Template, vars *outputVars) (string, error) {
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, vars); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// wrap applies output size limit and timestamps to the writer
+func (c *OutputConfig) wrap(w io.Writer) io.Writer {
+	if c.MaxBytes > 0 {
+		w = &limitWriter{w: w, remaining: c.MaxBytes}
+	}
+	if c.Timestamps {
+		w = &timestampWriter{w: w, lineStart: true}
+	}
+	return &syncWriter{w: w}
+}
+
+// Placeholders of the run fields in output paths, and patterns of their values
+var outputPathFields = []struct {
+	placeholder string
+	pattern     string
+}{
+	{"\x00id\x00", "[0-9]+"},
+	{"\x00started_at\x00", "[0-9]{8}-[0-9]{6}"},
+	{"\x00attempt\x00", "[0-9]+"},
+}
+
+// outputFilePattern returns the glob and the exact pattern matching output
+// files of all runs of the job. Returns nil pattern if the path does not
+// depend on the run.
+func outputFilePattern(tmpl *template.Template, name string) (string, *regexp.Regexp, error) {
+	vars := &outputVars{
+		Name:      strings.Replace(name, string(filepath.Separator), "_", -1),
+		ID:        outputPathFields[0].placeholder,
+		StartedAt: outputPathFields[1].placeholder,
+		Attempt:   outputPathFields[2].placeholder,
+	}
+
+	path, err := renderOutputPath(tmpl, vars)
+	if err != nil {
+		return "", nil, err
+	}
+
+	glob := globEscaper.Replace(path)
+	pattern := regexp.QuoteMeta(path)
+	found := false
+	for _, field := range outputPathFields {
+		if strings.Contains(path, field.placeholder) {
+			found = true
+		}
+		glob = strings.Replace(glob, field.placeholder, "*", -1)
+		pattern = strings.Replace(pattern, field.placeholder, field.pattern, -1)
+	}
+	if !found {
+		return "", nil, nil
+	}
+
+	matcher, err := regexp.Compile("^" + pattern + "$")
+	return glob, matcher, err
+}
+
+// globEscaper escapes glob metacharacters
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`)
+
+// rotate removes old output files of the job according to retention limits
+func (c *OutputConfig) rotate(name string) {
+	if c.KeepRuns == 0 && c.KeepDays == 0 {
+		return
+	}
+
+	templates := []*template.Template{c.pathTemplate}
+	if c.stderrTemplate != nil {
+		templates = append(templates, c.stderrTemplate)
+	}
+
+	for _, tmpl := range templates {
+		pattern, matcher, err := outputFilePattern(tmpl, name)
+		if err != nil || matcher == nil {
+			continue
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Printf("[%s] cant list output files: %v\n", name, err)
+			continue
+		}
+
+		files := []os.FileInfo{}
+		paths := map[os.FileInfo]string{}
+		for _, path := range matches {
+			// Glob could match files of jobs with a longer name
+			if !matcher.MatchString(path) {
+				continue
+			}
+			info, err := os.Stat(path)
+			if err != nil || info.IsDir() {
+				continue
+			}
+			files = append(files, info)
+			paths[info] = path
+		}
+
+		// Newest files first
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].ModTime().After(files[j].ModTime())
+		})
+
+		minTime := time.Now().AddDate(0, 0, -c.KeepDays)
+		for i, info := range files {
+			if (c.KeepRuns > 0 && i >= c.KeepRuns) || (c.KeepDays > 0 && info.ModTime().Before(minTime)) {
+				if err := os.Remove(paths[info]); err != nil {
+					log.Printf("[%s] cant remove output file: %v\n", name, err)
+				}
+			}
+		}
+	}
+}
+
+// syncWriter serializes writes from stdout and stderr of the process
+type syncWriter struct {
+	w    io.Writer
+	lock sync.Mutex
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.w.Write(p)
+}
+
+// limitWriter writes up to the given number of bytes and discards the rest
+type limitWriter struct {
+	w         io.Writer
+	remaining int64
+	truncated bool
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if l.truncated {
+		return len(p), nil
+	}
+
+	if int64(len(p)) <= l.remaining {
+		n, err := l.w.Write(p)
+		l.remaining -= int64(n)
+		return n, err
+	}
+
+	if _, err := l.w.Write(p[:l.remaining]); err != nil {
+		return 0, err
+	}
+	l.remaining = 0
+	l.truncated = true
+
+	if _, err := io.WriteString(l.w, "\n[output truncated]\n"); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// timestampWriter prefixes every line of the output with the current time
+type timestampWriter struct {
+	w         io.Writer
+	lineStart bool
+}
+
+func (t *timestampWriter) Write(p []byte) (int, error) {
+	buf := &bytes.Buffer{}
+
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if t.lineStart {
+			buf.WriteString(time.Now().Format(time.RFC3339))
+			buf.WriteByte(' ')
+		}
+		buf.Write(line)
+		t.lineStart = line[len(line)-1] == '\n'
+	}
+
+	if _, err := t.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// outputPipe copies the command output into the run output. Unlike the
+// exec package, waiting for the command does not wait for the processes it
+// has left behind to close the output.
+type outputPipe struct {
+	r    *os.File
+	w    *os.File
+	lock sync.Mutex
+	dst  io.Writer
+	done chan struct{}
+}
+
+func newOutputPipe(dst io.Writer) (*outputPipe, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &outputPipe{r: r, w: w, dst: dst, done: make(chan struct{})}
+	go p.copy()
+
+	return p, nil
+}
+
+func (p *outputPipe) copy() {
+	defer close(p.done)
+	defer p.r.Close()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := p.r.Read(buf)
+		if n > 0 {
+			p.lock.Lock()
+			if p.dst != nil {
+				p.dst.Write(buf[:n])
+			}
+			p.lock.Unlock()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// closeWriter closes the write end of the pipe once the command is started
+func (p *outputPipe) closeWriter() {
+	p.w.Close()
+}
+
+// wait waits for all writers to close the pipe. Returns false on timeout.
+func (p *outputPipe) wait(timeout time.Duration) bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+	}
+
+	select {
+	case <-p.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// detach stops writing into the run output. The pipe is still drained, so
+// the processes holding it are not blocked or killed with SIGPIPE.
+func (p *outputPipe) detach() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.dst = nil
+}
+
+// pipeOutput connects the command output to the run output through pipes
+func pipeOutput(cmd *exec.Cmd, out *runOutput) ([]*outputPipe, error) {
+	stdout, err := newOutputPipe(out.stdout)
+	if err != nil {
+		return nil, err
+	}
+	pipes := []*outputPipe{stdout}
+	cmd.Stdout = stdout.w
+	cmd.Stderr = stdout.w
+
+	if out.stderr != out.stdout {
+		stderr, err := newOutputPipe(out.stderr)
+		if err != nil {
+			stdout.closeWriter()
+			return nil, err
+		}
+		pipes = append(pipes, stderr)
+		cmd.Stderr = stderr.w
+	}
+
+	return pipes, nil
+}
+
+// closeOutput waits for the output of the finished command. Output of the
+// processes that keep running is not captured after the drain timeout.
+func closeOutput(j *Job, pipes []*outputPipe) {
+	for _, p := range pipes {
+		p.closeWriter()
+	}
+
+	deadline := time.Now().Add(outputDrainTimeout)
+	detached := false
+	for _, p := range pipes {
+		if !p.wait(time.Until(deadline)) {
+			p.detach()
+			detached = true
+		}
+	}
+	if detached {
+		log.Printf("[%s] output is still open by lingering processes, not capturing it anymore\n", j.config.Name)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestOutputRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cron2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{
+		"backup-20190101-000000.log",
+		"backup-20190102-000000.log",
+		"backup-20190103-000000.log",
+		"backup-db-20190101-000000.log",
+		"backup-db-20190102-000000.log",
+		"backup-notes.log",
+		"[x]-20190101-000000.log",
+		"[x]-20190102-000000.log",
+		"x-20190101-000000.log",
+	}
+	for i, name := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Now().Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := &OutputConfig{
+		Path:     filepath.Join(dir, "{{.Name}}-{{.StartedAt}}.log"),
+		KeepRuns: 1,
+	}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	config.rotate("backup")
+	config.rotate("[x]")
+
+	matches, _ := filepath.Glob(filepath.Join(dir, "*"))
+	left := []string{}
+	for _, path := range matches {
+		left = append(left, filepath.Base(path))
+	}
+	sort.Strings(left)
+
+	expected := []string{
+		"[x]-20190102-000000.log",
+		"backup-20190103-000000.log",
+		"backup-db-20190101-000000.log",
+		"backup-db-20190102-000000.log",
+		"backup-notes.log",
+		"x-20190101-000000.log",
+	}
+	if len(left) != len(expected) {
+		t.Fatalf("files left: %q, expected %q", left, expected)
+	}
+	for i := range left {
+		if left[i] != expected[i] {
+			t.Fatalf("files left: %q, expected %q", left, expected)
+		}
+	}
+}
+
+func TestOutputRotateRequiresName(t *testing.T) {
+	config := &OutputConfig{
+		Path:     "/var/log/cron2/{{.StartedAt}}.log",
+		KeepRuns: 10,
+	}
+	if err := config.validate(); err == nil {
+		t.Fatal("expected error for path without job name")
+	}
+
+	config.KeepRuns = 0
+	if err := config.validate(); err != nil {
+		t.Fatalf("unexpected error without rotation: %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+)
+
+const (
+	// Interval of checks for descendants of the running job
+	trackInterval = time.Second
+
+	// Interval of checks for exited orphans adopted by the service
+	reapInterval = time.Second
+
+	// Interval of checks for exited processes when killing them
+	killPollInterval = 100 * time.Millisecond
+)
+
+// procInfo represents the state of the process
+type procInfo struct {
+	pid       int
+	ppid      int
+	pgid      int
+	state     byte   // R, S, Z, etc
+	startTime uint64 // Start time since boot, tells reused PIDs apart
+	command   string
+}
+
+// alive returns true if the process is the same one and has not exited
+func (p *procInfo) alive() bool {
+	info, err := readProc(p.pid)
+	if err != nil {
+		return false
+	}
+	return info.startTime == p.startTime && info.state != 'Z'
+}
+
+// processTracker keeps track of the descendants of the job command. Orphaned
+// descendants are reparented to the service, so the tree is recorded while
+// the command is running.
+type processTracker struct {
+	pid   int
+	env   string // Env var of the run, inherited by the descendants
+	procs map[int]*procInfo
+}
+
+func newProcessTracker(pid int, env string) *processTracker {
+	return &processTracker{
+		pid:   pid,
+		env:   env,
+		procs: map[int]*procInfo{},
+	}
+}
+
+// scan adds new children of the tracked processes
+func (t *processTracker) scan() {
+	queue := []int{t.pid}
+	for pid := range t.procs {
+		queue = append(queue, pid)
+	}
+
+	for len(queue) > 0 {
+		pid := queue[0]
+		queue = queue[1:]
+
+		for _, child := range procChildren(pid) {
+			if _, ok := t.procs[child]; ok {
+				continue
+			}
+			info, err := readProc(child)
+			if err != nil {
+				continue
+			}
+			t.procs[child] = info
+			queue = append(queue, child)
+		}
+	}
+}
+
+// lingering returns descendants that are still running after the command
+// has exited, including the processes left in the job process group and
+// the ones adopted by the service before they were scanned
+func (t *processTracker) lingering() []*procInfo {
+	for _, pid := range procGroup(t.pid) {
+		t.add(pid)
+	}
+	for _, pid := range procChildren(os.Getpid()) {
+		if t.adopted(pid) {
+			t.add(pid)
+		}
+	}
+	t.scan()
+
+	result := []*procInfo{}
+	for pid, info := range t.procs {
+		if pid != t.pid && info.alive() {
+			result = append(result, info)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].pid < result[j].pid })
+
+	return result
+}
+
+// add starts tracking of the process
+func (t *processTracker) add(pid int) {
+	if _, ok := t.procs[pid]; ok || pid == t.pid {
+		return
+	}
+	if info, err := readProc(pid); err == nil {
+		t.procs[pid] = info
+	}
+}
+
+// adopted returns true if the child of the service was started by the job.
+// Processes started by the service itself do not have the run env var.
+func (t *processTracker) adopted(pid int) bool {
+	if t.env == "" {
+		return false
+	}
+	for _, env := range procEnv(pid) {
+		if env == t.env {
+			return true
+		}
+	}
+	return false
+}
+
+// checkLingering returns descendants left running by the command, and kills
+// them if required by the job policy
+func checkLingering(j *Job, tracker *processTracker) []lingeringProcess {
+	procs := tracker.lingering()
+	if len(procs) == 0 {
+		return nil
+	}
+	log.Printf("[%s] %d processes are still running after the command has exited\n", j.config.Name, len(procs))
+
+	kill := j.config.OnExit == exitKill
+	if kill {
+		killProcesses(j, procs)
+	}
+
+	result := make([]lingeringProcess, len(procs))
+	for i, p := range procs {
+		result[i] = lingeringProcess{PID: p.pid, Command: p.command, Killed: kill}
+	}
+	return result
+}
+
+// groupRunning returns true if any process of the group is running, exited
+// processes that are not reaped yet are not counted
+func groupRunning(pgid int) bool {
+	if err := syscall.Kill(-pgid, 0); err != nil {
+		return false
+	}
+
+	// Without process info the group is running until it is reaped
+	pids := procGroup(pgid)
+	if pids == nil {
+		return true
+	}
+	for _, pid := range pids {
+		if info, err := readProc(pid); err == nil && info.state != 'Z' {
+			return true
+		}
+	}
+	return false
+}
+
+// killProcesses sends the kill signal to the processes and kills the ones
+// that are still running after the kill timeout
+func killProcesses(j *Job, procs []*procInfo) {
+	for _, p := range procs {
+		log.Printf("[%s] sending %v to lingering process %d: %s\n", j.config.Name, j.config.KillSignal, p.pid, p.command)
+		if err := syscall.Kill(p.pid, j.config.KillSignal); err != nil {
+			log.Printf("[%s] cant signal process %d: %v\n", j.config.Name, p.pid, err)
+		}
+	}
+
+	deadline := time.Now().Add(j.config.KillTimeout)
+	for {
+		running := []*procInfo{}
+		for _, p := range procs {
+			if p.alive() {
+				running = append(running, p)
+			}
+		}
+		if len(running) == 0 {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			for _, p := range running {
+				log.Printf("[%s] process %d is still running after %v, killing\n", j.config.Name, p.pid, j.config.KillTimeout)
+				if err := syscall.Kill(p.pid, syscall.SIGKILL); err != nil {
+					log.Printf("[%s] cant kill process %d: %v\n", j.config.Name, p.pid, err)
+				}
+			}
+			return
+		}
+		time.Sleep(killPollInterval)
+	}
+}
+
+// reap waits for orphaned processes adopted by the service. Commands started
+// by the service are waited by their runners, so a zombie is reaped only if
+// it is left unattended for the whole interval.
+func (s *Service) reap() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	zombies := map[int]bool{}
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		found := map[int]bool{}
+		for _, pid := range procChildren(os.Getpid()) {
+			info, err := readProc(pid)
+			if err != nil || info.state != 'Z' {
+				continue
+			}
+			if !zombies[pid] {
+				found[pid] = true
+				continue
+			}
+
+			var status syscall.WaitStatus
+			if wpid, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil); err == nil && wpid == pid {
+				log.Printf("reaped orphaned process %d: %s\n", pid, info.command)
+			}
+		}
+		zombies = found
+	}
+}
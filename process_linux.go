@@ -0,0 +1,111 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// prctl option to adopt orphaned descendants instead of init
+const prSetChildSubreaper = 36
+
+// setSubreaper makes the service the parent of orphaned descendants, so that
+// processes left behind by jobs could be tracked and reaped
+func setSubreaper() error {
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// readProc returns the process state from /proc
+func readProc(pid int) (*procInfo, error) {
+	data, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return nil, err
+	}
+
+	// Command name is in parentheses and could contain spaces
+	start := bytes.IndexByte(data, '(')
+	end := bytes.LastIndexByte(data, ')')
+	if start < 0 || end < start {
+		return nil, errors.New("invalid stat format")
+	}
+
+	// Fields after the command name, starting with the process state
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 20 {
+		return nil, errors.New("invalid stat format")
+	}
+
+	info := &procInfo{
+		pid:     pid,
+		state:   fields[0][0],
+		command: string(data[start+1 : end]),
+	}
+	info.ppid, _ = strconv.Atoi(fields[1])
+	info.pgid, _ = strconv.Atoi(fields[2])
+	info.startTime, _ = strconv.ParseUint(fields[19], 10, 64)
+
+	if cmdline, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/cmdline"); err == nil && len(cmdline) > 0 {
+		info.command = strings.TrimSpace(string(bytes.Replace(cmdline, []byte{0}, []byte{' '}, -1)))
+	}
+
+	return info, nil
+}
+
+// procChildren returns PIDs of the process children
+func procChildren(pid int) []int {
+	files, _ := filepath.Glob("/proc/" + strconv.Itoa(pid) + "/task/*/children")
+
+	children := []int{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		for _, field := range strings.Fields(string(data)) {
+			if child, err := strconv.Atoi(field); err == nil {
+				children = append(children, child)
+			}
+		}
+	}
+	return children
+}
+
+// procEnv returns the environment the process was started with
+func procEnv(pid int) []string {
+	data, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/environ")
+	if err != nil {
+		return nil
+	}
+	return strings.Split(string(bytes.TrimRight(data, "\x00")), "\x00")
+}
+
+// procGroup returns PIDs of all processes in the process group
+func procGroup(pgid int) []int {
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	pids := []int{}
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(dir.Name())
+		if err != nil {
+			continue
+		}
+		if info, err := readProc(pid); err == nil && info.pgid == pgid {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
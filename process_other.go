@@ -0,0 +1,33 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// setSubreaper is only supported on linux
+func setSubreaper() error {
+	return errors.New("child subreaper is not supported on this platform")
+}
+
+// readProc is only supported on linux
+func readProc(pid int) (*procInfo, error) {
+	return nil, errors.New("process info is not supported on this platform")
+}
+
+// procChildren is only supported on linux
+func procChildren(pid int) []int {
+	return nil
+}
+
+// procEnv is only supported on linux
+func procEnv(pid int) []string {
+	return nil
+}
+
+// procGroup is only supported on linux
+func procGroup(pgid int) []int {
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Version of the control socket protocol
+const protocolVersion = 1
+
+// Protocol commands
+const (
+	cmdRun     = "run"
+	cmdList    = "list"
+	cmdReload  = "reload"
+	cmdHistory = "history"
+)
+
+// Response message types
+const (
+	responseData  = "data"  // Single item of the streaming reply
+	responseOk    = "ok"    // Successful end of the reply
+	responseError = "error" // Failed end of the reply
+)
+
+// Error codes
+const (
+	errCodeInvalidRequest     = "invalid_request"
+	errCodeUnsupportedVersion = "unsupported_version"
+	errCodeInvalidCommand     = "invalid_command"
+	errCodeJobRequired        = "job_required"
+	errCodeNotFound           = "not_found"
+	errCodeShuttingDown       = "shutting_down"
+	errCodeInvalidConfig      = "invalid_config"
+)
+
+var (
+	errJobNotFound  = errors.New("job not found")
+	errShuttingDown = errors.New("service is shutting down")
+)
+
+// request represents a single command sent to the control socket.
+// Requests are encoded as JSON, one request per line.
+type request struct {
+	Version int    `json:"version"`
+	Command string `json:"command"`
+	Job     string `json:"job,omitempty"`
+	Limit   int    `json:"limit,omitempty"`
+}
+
+// response represents a single message of the reply. Reply consists of any
+// number of data messages followed by exactly one ok or error message.
+type response struct {
+	Version int             `json:"version"`
+	Type    string          `json:"type"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Message string          `json:"message,omitempty"`
+	Error   *responseErr    `json:"error,omitempty"`
+}
+
+// responseErr represents the error details of the reply
+type responseErr struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error returns the error text
+func (e *responseErr) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// jobStatus represents the job listing entry
+type jobStatus struct {
+	Name     string     `json:"name"`
+	State    string     `json:"state"`
+	Spec     string     `json:"spec"`
+	Timezone string     `json:"tz,omitempty"`
+	Command  string     `json:"command"`
+	NextRun  *time.Time `json:"next_run,omitempty"`
+	jobState
+}
+
+// String returns a short description of the job
+func (s *jobStatus) String() string {
+	next := "n/a"
+	if s.NextRun != nil {
+		next = s.NextRun.Format(time.RFC3339)
+	}
+	return fmt.Sprintf(
+		"[%s] %s: %s %s -> next run at %s, %s",
+		s.State, s.Name, s.Spec, s.Command, next, s.jobState,
+	)
+}
@@ -1,23 +1,71 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 
+	multierror "github.com/hashicorp/go-multierror"
 	"gopkg.in/robfig/cron.v2"
 )
 
+const (
+	// Default time to wait for running jobs on shutdown
+	defaultShutdownTimeout = 30 * time.Second
+
+	// Time to wait for jobs to exit after SIGTERM before sending SIGKILL
+	shutdownKillTimeout = 10 * time.Second
+
+	// Max time to wait for notifications and history after jobs have exited
+	shutdownFlushTimeout = 30 * time.Second
+)
+
 type Service struct {
 	config     *Config
+	configPath string
 	configLock *sync.Mutex
 	scheduler  *cron.Cron
+	history    *historyStore
+	state      *stateRegistry
+	metrics    *metricsRegistry
+	docker     *dockerClient // Created on first use, see dockerAPI
+	runs       *sync.WaitGroup
+	stopping   bool
+	done       chan struct{} // Closed when shutdown begins
+	stopped    chan struct{} // Closed when shutdown is complete
 }
 
-func newService(config *Config) (*Service, error) {
+func newService(config *Config, configPath string) (*Service, error) {
+	history, err := newHistoryStore(config.History)
+	if err != nil {
+		return nil, err
+	}
+
+	// Restore last run results from history
+	state := newStateRegistry()
+	for _, job := range config.Jobs {
+		state.restore(job.Name, history.list(job.Name, 0))
+	}
+
+	// Initial config load counts as a successful reload
+	metrics := newMetricsRegistry()
+	metrics.reloaded(true)
+
 	return &Service{
 		config:     config,
+		configPath: configPath,
 		configLock: new(sync.Mutex),
 		scheduler:  cron.New(),
+		history:    history,
+		state:      state,
+		metrics:    metrics,
+		runs:       new(sync.WaitGroup),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
 	}, nil
 }
 
@@ -35,27 +83,135 @@ func (s *Service) addJobs() error {
 	}
 
 	for _, config := range s.config.Jobs {
-		if config.Disabled {
-			log.Printf("job %q is disabled, skipping\n", config.Name)
-			continue
-		}
-
-		log.Printf("adding job %q\n", config.Name)
-		entry, err := s.scheduler.AddJob(config.fullSpec(), Job{config: config})
-		if err != nil {
+		if err := s.schedule(config); err != nil {
 			return err
 		}
-		config.ID = int(entry)
 	}
 
 	return nil
 }
 
-func (s *Service) reload(config *Config) error {
+// schedule adds the job to the scheduler, must be called with config lock held
+func (s *Service) schedule(config *JobConfig) error {
+	if config.Disabled {
+		log.Printf("job %q is disabled, skipping\n", config.Name)
+		return nil
+	}
+
+	log.Printf("adding job %q\n", config.Name)
+	entry, err := s.scheduler.AddJob(config.fullSpec(), Job{config: config, service: s, trigger: triggerSchedule})
+	if err != nil {
+		return err
+	}
+	config.ID = int(entry)
+
+	return nil
+}
+
+// unschedule removes the job from the scheduler and applies the reload policy
+// to its running instances, must be called with config lock held
+func (s *Service) unschedule(config *JobConfig) {
+	if config.ID > 0 {
+		log.Printf("removing job %q\n", config.Name)
+		s.scheduler.Remove(cron.EntryID(config.ID))
+		config.ID = 0
+	}
+
+	if config.OnReload == reloadStop {
+		for _, id := range s.state.cancel(config.Name, resultCancelled) {
+			log.Printf("[%s] stopping run #%d\n", config.Name, id)
+		}
+	}
+}
+
+// reload applies the new config and returns the list of job changes. Jobs
+// that did not change keep their scheduler entries and running instances.
+func (s *Service) reload(config *Config) (*configDiff, error) {
 	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	diff := diffConfigs(s.config, config)
+	log.Println("config changes:", diff)
+
+	for _, name := range diff.Removed {
+		s.unschedule(s.config.findJob(name))
+	}
+	for _, name := range diff.Changed {
+		s.unschedule(s.config.findJob(name))
+	}
+
+	// Keep existing configs of unchanged jobs
+	for i, job := range config.Jobs {
+		if prev := s.config.findJob(job.Name); prev != nil && diff.isUnchanged(job.Name) {
+			config.Jobs[i] = prev
+		}
+	}
 	s.config = config
+
+	var result error
+	for _, name := range append(diff.Added, diff.Changed...) {
+		if err := s.schedule(config.findJob(name)); err != nil {
+			result = multierror.Append(result, fmt.Errorf("cant schedule job %q: %v", name, err))
+		}
+	}
+
+	return diff, result
+}
+
+// trigger starts the job run outside of its schedule
+func (s *Service) trigger(name string, source string) error {
+	s.configLock.Lock()
+	config := s.config.findJob(name)
 	s.configLock.Unlock()
-	return s.addJobs()
+
+	if config == nil {
+		return errJobNotFound
+	}
+	if s.isStopping() {
+		return errShuttingDown
+	}
+
+	job := Job{config: config, service: s, trigger: source}
+	go job.Run()
+
+	return nil
+}
+
+// jobStatuses returns the list of all jobs with their runtime state
+func (s *Service) jobStatuses() []*jobStatus {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	result := make([]*jobStatus, 0, len(s.config.Jobs))
+	for _, j := range s.config.Jobs {
+		status := &jobStatus{
+			Name:     j.Name,
+			State:    j.state(),
+			Spec:     j.Spec,
+			Timezone: j.Timezone,
+			Command:  j.Command,
+			jobState: s.state.get(j.Name),
+		}
+		if next, err := j.nextRun(); err == nil {
+			status.NextRun = &next
+		}
+		result = append(result, status)
+	}
+	return result
+}
+
+// reloadFile reads the config from the service config path and applies it
+func (s *Service) reloadFile() (*configDiff, error) {
+	config, err := readConfig(s.configPath)
+	if err != nil {
+		s.metrics.reloaded(false)
+		return nil, err
+	}
+
+	diff, err := s.reload(config)
+	s.metrics.reloaded(err == nil)
+
+	return diff, err
 }
 
 func (s *Service) start() error {
@@ -63,14 +219,113 @@ func (s *Service) start() error {
 		return err
 	}
 
-	log.Println("starting scheduler")
-	defer log.Println("scheduler has stopped")
+	s.removeOrphanContainers()
+
+	// Adopt processes left behind by jobs to track and reap them
+	if err := setSubreaper(); err != nil {
+		log.Printf("cant become child subreaper: %v\n", err)
+	} else {
+		go s.reap()
+	}
 
+	log.Println("starting scheduler")
 	s.scheduler.Start()
-	defer s.scheduler.Stop()
 
-	// TODO: add channels to handle shutdown
-	select {}
+	go s.watch()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			log.Println("received SIGHUP, reloading config")
+			if _, err := s.reloadFile(); err != nil {
+				log.Println("reload error:", err)
+			}
+			continue
+		}
+
+		log.Printf("received %v, shutting down\n", sig)
+		break
+	}
 
+	s.stop()
 	return nil
 }
+
+// stop stops scheduling new runs and waits for running jobs to finish.
+// Jobs that are still running after the shutdown timeout are terminated.
+func (s *Service) stop() {
+	s.configLock.Lock()
+	s.stopping = true
+	timeout := s.config.ShutdownTimeout
+	s.configLock.Unlock()
+
+	close(s.done)
+	defer close(s.stopped)
+
+	s.scheduler.Stop()
+	log.Println("scheduler has stopped")
+
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+
+	log.Printf("waiting up to %v for running jobs\n", timeout)
+	if s.wait(timeout) {
+		log.Println("all jobs have finished")
+		return
+	}
+
+	s.state.signal(syscall.SIGTERM)
+	if s.wait(shutdownKillTimeout) {
+		return
+	}
+
+	s.state.signal(syscall.SIGKILL)
+	if !s.wait(shutdownFlushTimeout) {
+		log.Println("some jobs did not finish in time")
+	}
+}
+
+// wait waits for all running jobs to finish. Returns false on timeout.
+func (s *Service) wait(timeout time.Duration) bool {
+	finished := make(chan struct{})
+	go func() {
+		s.runs.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// begin registers a new job run. Returns false if the service is shutting down.
+func (s *Service) begin() bool {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	if s.stopping {
+		return false
+	}
+	s.runs.Add(1)
+	return true
+}
+
+// end marks the job run as finished
+func (s *Service) end() {
+	s.runs.Done()
+}
+
+// isStopping returns true if the service is shutting down
+func (s *Service) isStopping() bool {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	return s.stopping
+}
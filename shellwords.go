@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// wordsError represents a command parsing error at the given position
+type wordsError struct {
+	message string
+	line    int
+	column  int
+}
+
+func (e *wordsError) Error() string {
+	return fmt.Sprintf("%s at line %d, column %d", e.message, e.line, e.column)
+}
+
+// wordsParser splits the input into words following POSIX shell rules
+type wordsParser struct {
+	input  []rune
+	pos    int
+	lookup func(string) string
+}
+
+// splitWords splits the command into arguments. It supports single and double
+// quotes, backslash escapes and $VAR or ${VAR} expansion. Variables are
+// resolved with the lookup function, expanded values are not split further.
+func splitWords(input string, lookup func(string) string) ([]string, error) {
+	p := &wordsParser{input: []rune(input), lookup: lookup}
+	return p.parse()
+}
+
+func (p *wordsParser) parse() ([]string, error) {
+	words := []string{}
+	word := &strings.Builder{}
+	inWord := false // Quoted empty string is still a word
+
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			p.pos++
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\\':
+			p.pos++
+			if p.pos >= len(p.input) {
+				return nil, p.errorAt(p.pos-1, "trailing backslash")
+			}
+			// Escaped newline joins the lines
+			if p.input[p.pos] != '\n' {
+				word.WriteRune(p.input[p.pos])
+				inWord = true
+			}
+			p.pos++
+		case c == '\'':
+			if err := p.singleQuoted(word); err != nil {
+				return nil, err
+			}
+			inWord = true
+		case c == '"':
+			if err := p.doubleQuoted(word); err != nil {
+				return nil, err
+			}
+			inWord = true
+		case c == '$':
+			value, err := p.variable()
+			if err != nil {
+				return nil, err
+			}
+			if value != "" {
+				word.WriteString(value)
+				inWord = true
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+			p.pos++
+		}
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// singleQuoted reads the string up to the closing single quote as is
+func (p *wordsParser) singleQuoted(word *strings.Builder) error {
+	start := p.pos
+	p.pos++
+
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		p.pos++
+		if c == '\'' {
+			return nil
+		}
+		word.WriteRune(c)
+	}
+
+	return p.errorAt(start, "unterminated single quote")
+}
+
+// doubleQuoted reads the string up to the closing double quote, expanding
+// variables and escape sequences
+func (p *wordsParser) doubleQuoted(word *strings.Builder) error {
+	start := p.pos
+	p.pos++
+
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+
+		switch c {
+		case '"':
+			p.pos++
+			return nil
+		case '\\':
+			p.pos++
+			if p.pos >= len(p.input) {
+				continue
+			}
+			switch next := p.input[p.pos]; next {
+			case '$', '`', '"', '\\':
+				word.WriteRune(next)
+			case '\n':
+			default:
+				word.WriteRune('\\')
+				word.WriteRune(next)
+			}
+			p.pos++
+		case '$':
+			value, err := p.variable()
+			if err != nil {
+				return err
+			}
+			word.WriteString(value)
+		default:
+			word.WriteRune(c)
+			p.pos++
+		}
+	}
+
+	return p.errorAt(start, "unterminated double quote")
+}
+
+// variable reads $NAME or ${NAME} and returns its value. Lone "$" is kept as is.
+func (p *wordsParser) variable() (string, error) {
+	start := p.pos
+	p.pos++
+
+	if p.pos < len(p.input) && p.input[p.pos] == '{' {
+		p.pos++
+		nameStart := p.pos
+		for p.pos < len(p.input) && p.input[p.pos] != '}' {
+			p.pos++
+		}
+		if p.pos >= len(p.input) {
+			return "", p.errorAt(start, "unterminated variable")
+		}
+
+		name := string(p.input[nameStart:p.pos])
+		p.pos++
+		if !isVariableName(name) {
+			return "", p.errorAt(start, fmt.Sprintf("invalid variable name %q", name))
+		}
+		return p.lookup(name), nil
+	}
+
+	nameStart := p.pos
+	for p.pos < len(p.input) && isVariableChar(p.input[p.pos], p.pos == nameStart) {
+		p.pos++
+	}
+	if p.pos == nameStart {
+		return "$", nil
+	}
+
+	return p.lookup(string(p.input[nameStart:p.pos])), nil
+}
+
+// errorAt returns the error with line and column of the given input offset
+func (p *wordsParser) errorAt(offset int, message string) error {
+	line, column := 1, 1
+	for _, c := range p.input[:offset] {
+		if c == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
+		}
+	}
+	return &wordsError{message: message, line: line, column: column}
+}
+
+func isVariableChar(c rune, first bool) bool {
+	switch {
+	case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		return true
+	case c >= '0' && c <= '9':
+		return !first
+	}
+	return false
+}
+
+func isVariableName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		if !isVariableChar(c, i == 0) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitWords(t *testing.T) {
+	env := map[string]string{
+		"NAME":  "world",
+		"SPACE": "a b",
+	}
+	lookup := func(name string) string { return env[name] }
+
+	examples := []struct {
+		input string
+		words []string
+	}{
+		{`grep "foo bar" file`, []string{"grep", "foo bar", "file"}},
+		{"ls  -al   /tmp", []string{"ls", "-al", "/tmp"}},
+		{"  echo\thello\n", []string{"echo", "hello"}},
+		{"echo ''", []string{"echo", ""}},
+		{`echo "" x`, []string{"echo", "", "x"}},
+		{"echo a\\\nb", []string{"echo", "ab"}},
+		{"echo \"a\\\nb\"", []string{"echo", "ab"}},
+		{`echo a\ b`, []string{"echo", "a b"}},
+		{`echo 'a\b $NAME'`, []string{"echo", `a\b $NAME`}},
+		{`echo "\$NAME \"q\" \n"`, []string{"echo", `$NAME "q" \n`}},
+		{"echo $NAME ${NAME}!", []string{"echo", "world", "world!"}},
+		{"echo $SPACE", []string{"echo", "a b"}},
+		{"echo $UNSET", []string{"echo"}},
+		{"echo a$UNSET", []string{"echo", "a"}},
+		{`echo "$UNSET"`, []string{"echo", ""}},
+		{"echo $ 5$", []string{"echo", "$", "5$"}},
+		{"", []string{}},
+	}
+
+	for _, ex := range examples {
+		words, err := splitWords(ex.input, lookup)
+		if err != nil {
+			t.Errorf("splitWords(%q) error: %v", ex.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(words, ex.words) {
+			t.Errorf("splitWords(%q) = %q, expected %q", ex.input, words, ex.words)
+		}
+	}
+}
+
+func TestSplitWordsErrors(t *testing.T) {
+	lookup := func(string) string { return "" }
+
+	examples := []struct {
+		input string
+		err   string
+	}{
+		{`echo "foo`, "unterminated double quote at line 1, column 6"},
+		{"echo ok\necho 'foo", "unterminated single quote at line 2, column 6"},
+		{"echo\n  ${NAME", "unterminated variable at line 2, column 3"},
+		{"echo ${1X}", `invalid variable name "1X" at line 1, column 6`},
+		{`echo foo\`, "trailing backslash at line 1, column 9"},
+	}
+
+	for _, ex := range examples {
+		_, err := splitWords(ex.input, lookup)
+		if err == nil {
+			t.Errorf("splitWords(%q) expected error", ex.input)
+			continue
+		}
+		if err.Error() != ex.err {
+			t.Errorf("splitWords(%q) error = %q, expected %q", ex.input, err, ex.err)
+		}
+	}
+}
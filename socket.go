@@ -1,13 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
-	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"strings"
-	"time"
 )
 
 var (
@@ -15,8 +16,13 @@ var (
 	replyNoJob      = []byte("err: job name required")
 	replyNotFound   = []byte("err: not found")
 	replyOk         = []byte("ok: scheduled")
+	replyNoRuns     = []byte("err: no runs found")
+	replyStopping   = []byte("err: service is shutting down")
 )
 
+// Max number of runs returned by the history command
+const historyLimit = 20
+
 func startListener(service *Service, path string) error {
 	if path == "" {
 		return errors.New("Socket path is required")
@@ -26,62 +32,205 @@ func startListener(service *Service, path string) error {
 	if err != nil {
 		return err
 	}
-	defer func() {
+	defer os.Remove(path)
+
+	// Keep the socket open until shutdown is complete
+	go func() {
+		<-service.stopped
 		listener.Close()
-		os.Remove(path)
 	}()
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			select {
+			case <-service.stopped:
+				return nil
+			default:
+			}
 			log.Println("cant accept connection:", err)
 			continue
 		}
 
-		go func() {
-			defer conn.Close()
+		go handleConn(service, conn)
+	}
+}
+
+// handleConn serves a single client connection. Clients of the JSON protocol
+// send requests starting with "{", anything else is a legacy text command.
+func handleConn(service *Service, conn net.Conn) {
+	defer conn.Close()
+
+	buf := make([]byte, 256)
+
+	n, err := conn.Read(buf)
+	if err != nil {
+		log.Println("read error:", err)
+		return
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(buf[0:n]), []byte("{")) {
+		handleJSON(service, conn, io.MultiReader(bytes.NewReader(buf[0:n]), conn))
+		return
+	}
+
+	handleText(service, conn, strings.TrimSpace(string(buf[0:n])))
+}
 
-			buf := make([]byte, 256)
+// handleText serves a legacy text command
+func handleText(service *Service, conn net.Conn, input string) {
+	chunks := strings.Split(input, " ")
 
-			n, err := conn.Read(buf)
-			if err != nil {
-				log.Println("read error:", err)
-				return
+	switch chunks[0] {
+	case cmdRun:
+		if len(chunks) < 2 {
+			conn.Write(replyNoJob)
+			return
+		}
+		switch service.trigger(strings.Join(chunks[1:], " "), triggerSocket) {
+		case errJobNotFound:
+			conn.Write(replyNotFound)
+		case errShuttingDown:
+			conn.Write(replyStopping)
+		default:
+			conn.Write(replyOk)
+		}
+	case cmdList:
+		lines := []string{}
+		for _, status := range service.jobStatuses() {
+			lines = append(lines, status.String())
+		}
+		conn.Write([]byte(strings.Join(lines, "\n")))
+	case cmdReload:
+		diff, err := service.reloadFile()
+		if err != nil {
+			conn.Write([]byte("err: " + err.Error()))
+			return
+		}
+		conn.Write([]byte("ok: reloaded, " + diff.String()))
+	case cmdHistory:
+		if len(chunks) < 2 {
+			conn.Write(replyNoJob)
+			return
+		}
+		runs := service.history.list(strings.Join(chunks[1:], " "), historyLimit)
+		if len(runs) == 0 {
+			conn.Write(replyNoRuns)
+			return
+		}
+		lines := []string{}
+		for _, run := range runs {
+			lines = append(lines, run.String())
+		}
+		conn.Write([]byte(strings.Join(lines, "\n")))
+	default:
+		conn.Write(replyInvalidCmd)
+	}
+}
+
+// handleJSON serves JSON protocol requests until the client disconnects
+func handleJSON(service *Service, conn net.Conn, input io.Reader) {
+	decoder := json.NewDecoder(input)
+	reply := &replyWriter{encoder: json.NewEncoder(conn)}
+
+	for {
+		req := request{}
+		if err := decoder.Decode(&req); err != nil {
+			if err != io.EOF {
+				reply.fail(errCodeInvalidRequest, err.Error())
 			}
+			return
+		}
 
-			input := strings.TrimSpace(string(buf[0:n]))
-			chunks := strings.Split(input, " ")
-
-			switch chunks[0] {
-			case "run":
-				if len(chunks) < 2 {
-					conn.Write(replyNoJob)
-					return
-				}
-				jobConfig := service.config.findJob(strings.Join(chunks[1:], " "))
-				if jobConfig == nil {
-					conn.Write(replyNotFound)
-					return
-				}
-				job := Job{config: jobConfig}
-				go job.Run()
-				conn.Write(replyOk)
-			case "list":
-				names := []string{}
-				for _, j := range service.config.Jobs {
-					next := "n/a"
-					nextTime, err := j.nextRun()
-					if err == nil {
-						next = nextTime.Format(time.RFC3339)
-					}
-					names = append(names, fmt.Sprintf("[%s] %s: %s %s -> next run at %s", j.state(), j.Name, j.Spec, j.Command, next))
-				}
-				conn.Write([]byte(strings.Join(names, "\n")))
-			default:
-				conn.Write(replyInvalidCmd)
+		if err := serveRequest(service, &req, reply); err != nil {
+			log.Println("write error:", err)
+			return
+		}
+	}
+}
+
+// serveRequest executes the command and writes the reply
+func serveRequest(service *Service, req *request, reply *replyWriter) error {
+	if req.Version > protocolVersion {
+		return reply.fail(errCodeUnsupportedVersion, "unsupported protocol version")
+	}
+
+	switch req.Command {
+	case cmdRun:
+		if req.Job == "" {
+			return reply.fail(errCodeJobRequired, "job name required")
+		}
+		switch err := service.trigger(req.Job, triggerSocket); err {
+		case errJobNotFound:
+			return reply.fail(errCodeNotFound, err.Error())
+		case errShuttingDown:
+			return reply.fail(errCodeShuttingDown, err.Error())
+		}
+		return reply.ok("scheduled", nil)
+	case cmdList:
+		for _, status := range service.jobStatuses() {
+			if err := reply.data(status); err != nil {
+				return err
+			}
+		}
+		return reply.ok("", nil)
+	case cmdReload:
+		diff, err := service.reloadFile()
+		if err != nil {
+			return reply.fail(errCodeInvalidConfig, err.Error())
+		}
+		return reply.ok("reloaded, "+diff.String(), diff)
+	case cmdHistory:
+		if req.Job == "" {
+			return reply.fail(errCodeJobRequired, "job name required")
+		}
+		limit := req.Limit
+		if limit <= 0 {
+			limit = historyLimit
+		}
+		for _, run := range service.history.list(req.Job, limit) {
+			if err := reply.data(run); err != nil {
+				return err
 			}
-		}()
+		}
+		return reply.ok("", nil)
+	default:
+		return reply.fail(errCodeInvalidCommand, "invalid command")
+	}
+}
+
+// replyWriter writes JSON protocol messages to the client
+type replyWriter struct {
+	encoder *json.Encoder
+}
+
+// data writes a single item of the reply
+func (w *replyWriter) data(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
 	}
+	return w.encoder.Encode(&response{Version: protocolVersion, Type: responseData, Data: data})
+}
+
+// ok writes the successful end of the reply
+func (w *replyWriter) ok(message string, v interface{}) error {
+	resp := &response{Version: protocolVersion, Type: responseOk, Message: message}
+	if v != nil {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		resp.Data = data
+	}
+	return w.encoder.Encode(resp)
+}
 
-	return nil
+// fail writes the error end of the reply
+func (w *replyWriter) fail(code string, message string) error {
+	return w.encoder.Encode(&response{
+		Version: protocolVersion,
+		Type:    responseError,
+		Error:   &responseErr{Code: code, Message: message},
+	})
 }
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// jobState represents the runtime state of a job
+type jobState struct {
+	Running        int           `json:"running"`          // Number of running instances
+	LastStartedAt  time.Time     `json:"last_started_at"`  // Start time of the last run
+	LastDuration   time.Duration `json:"last_duration"`    // Duration of the last run
+	LastExitStatus int           `json:"last_exit_status"` // Exit status of the last run
+	LastSuccess    bool          `json:"last_success"`     // Result of the last run
+	LastResult     string        `json:"last_result"`      // Outcome of the last run
+	LastSuccessAt  time.Time     `json:"last_success_at"`  // Finish time of the last successful run
+
+	// Number of failed runs since the last success, retries of the run are
+	// not counted
+	ConsecutiveFailures int `json:"consecutive_failures"`
+
+	instances    []*runInstance
+	alertedAt    time.Time // Time of the last failure alert, zero when not alerting
+	watchedSince time.Time // Time the watchdog has started checking the job
+	missedAt     time.Time // Time of the last missed success alert
+}
+
+// runInstance represents a single running instance of the job
+type runInstance struct {
+	id     int64
+	cancel context.CancelFunc
+	reason string // Why the run was stopped: replaced or cancelled
+	pgid   int
+	kill   func(sig syscall.Signal) error // Signals the run without a local process
+}
+
+// stateRegistry keeps runtime state for all jobs by name
+type stateRegistry struct {
+	lock   *sync.Mutex
+	states map[string]*jobState
+}
+
+func newStateRegistry() *stateRegistry {
+	return &stateRegistry{
+		lock:   new(sync.Mutex),
+		states: map[string]*jobState{},
+	}
+}
+
+// fetch returns the state of the job, must be called with lock held
+func (r *stateRegistry) fetch(name string) *jobState {
+	state := r.states[name]
+	if state == nil {
+		state = &jobState{}
+		r.states[name] = state
+	}
+	return state
+}
+
+// acquire reserves a run slot according to the job concurrency policy.
+// Returns IDs of the runs replaced by this one, or false if the run must be
+// skipped.
+func (r *stateRegistry) acquire(j *Job, cancel context.CancelFunc) ([]int64, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	state := r.fetch(j.config.Name)
+	limit := j.config.instanceLimit()
+	replaced := []int64{}
+
+	if limit > 0 && len(state.instances) >= limit {
+		if j.config.Concurrency != concurrencyReplace {
+			return nil, false
+		}
+
+		// Cancel the oldest runs to make room for the new one
+		for _, inst := range state.instances[:len(state.instances)-limit+1] {
+			if inst.reason == "" {
+				inst.reason = resultReplaced
+				inst.cancel()
+				replaced = append(replaced, inst.id)
+			}
+		}
+	}
+
+	j.instance = &runInstance{id: j.id, cancel: cancel}
+	state.instances = append(state.instances, j.instance)
+	state.Running = len(state.instances)
+	state.LastStartedAt = j.startedAt
+
+	return replaced, true
+}
+
+// stopReason returns the reason the job run was stopped early, if any
+func (r *stateRegistry) stopReason(j *Job) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return j.instance.reason
+}
+
+// cancel stops all running instances of the job. Returns IDs of the runs.
+func (r *stateRegistry) cancel(name string, reason string) []int64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	ids := []int64{}
+	if state := r.states[name]; state != nil {
+		for _, inst := range state.instances {
+			if inst.reason == "" {
+				inst.reason = reason
+				inst.cancel()
+				ids = append(ids, inst.id)
+			}
+		}
+	}
+	return ids
+}
+
+// setProcess sets the process group of the running command, zero means
+// there is no running process
+func (r *stateRegistry) setProcess(j *Job, pgid int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	j.instance.pgid = pgid
+}
+
+// setKill sets the function to signal the run that has no local process,
+// e.g. a container started through the docker API. Nil removes it.
+func (r *stateRegistry) setKill(j *Job, kill func(sig syscall.Signal) error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	j.instance.kill = kill
+}
+
+// signal sends the signal to process groups of all running jobs
+func (r *stateRegistry) signal(sig syscall.Signal) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for name, state := range r.states {
+		for _, inst := range state.instances {
+			var err error
+			switch {
+			case inst.pgid > 0:
+				log.Printf("[%s] sending %v to run #%d\n", name, sig, inst.id)
+				err = syscall.Kill(-inst.pgid, sig)
+			case inst.kill != nil:
+				log.Printf("[%s] sending %v to run #%d\n", name, sig, inst.id)
+				err = inst.kill(sig)
+			default:
+				continue
+			}
+			if err != nil {
+				log.Printf("[%s] cant signal run #%d: %v\n", name, inst.id, err)
+			}
+		}
+	}
+}
+
+// release frees the run slot taken by the job run
+func (r *stateRegistry) release(j *Job) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	state := r.fetch(j.config.Name)
+	for i, inst := range state.instances {
+		if inst == j.instance {
+			state.instances = append(state.instances[:i], state.instances[i+1:]...)
+			break
+		}
+	}
+	state.Running = len(state.instances)
+}
+
+// update records the result of the job run
+func (r *stateRegistry) update(j *Job) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	state := r.fetch(j.config.Name)
+	state.LastStartedAt = j.startedAt
+	state.LastDuration = j.duration
+	state.LastExitStatus = j.exitStatus
+	state.LastSuccess = j.success
+	state.LastResult = j.result
+	if j.success {
+		state.LastSuccessAt = j.startedAt.Add(j.duration)
+		state.ConsecutiveFailures = 0
+	}
+
+	// Failed attempts of the retried run count as a single failure
+	if failed(j.result) && j.attempt <= 1 {
+		state.ConsecutiveFailures++
+	}
+}
+
+// alert applies the notification policy of the job to its state. Returns
+// true if the notification must be sent, and marks the failure alert as sent.
+func (r *stateRegistry) alert(j *Job) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	state := r.fetch(j.config.Name)
+	notify := j.config.Notify
+
+	switch j.result {
+	case resultSuccess:
+		// Recovery is reported only when the failure was reported
+		alerting := !state.alertedAt.IsZero()
+		state.alertedAt = time.Time{}
+
+		switch notify.Mode {
+		case notifyAll:
+			return true
+		case notifyChange:
+			return alerting
+		}
+		return false
+
+	case resultFailure, resultTimeout:
+		if state.ConsecutiveFailures < notify.After {
+			return false
+		}
+
+		// The job is known to be broken, remind about it after the realert
+		// interval only
+		if !state.alertedAt.IsZero() {
+			if notify.Realert > 0 && time.Since(state.alertedAt) < notify.Realert {
+				return false
+			}
+			if notify.Realert == 0 && notify.Mode == notifyChange {
+				return false
+			}
+		}
+
+		state.alertedAt = time.Now()
+		return true
+	}
+
+	// Missed success window is reported by the watchdog once per window
+	if j.result == resultMissed {
+		return true
+	}
+
+	// Skipped, replaced and cancelled runs do not change the job health
+	return notify.Mode != notifyChange
+}
+
+// missed returns true if the job has not succeeded within the expected
+// window and the alert is due. Jobs that never succeeded are checked from the
+// time the watchdog has seen them first.
+func (r *stateRegistry) missed(config *JobConfig, now time.Time) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	state := r.fetch(config.Name)
+	if state.watchedSince.IsZero() {
+		state.watchedSince = now
+	}
+
+	since := state.LastSuccessAt
+	if since.IsZero() {
+		since = state.watchedSince
+	}
+
+	window := config.ExpectSuccessWithin
+	if now.Sub(since) < window {
+		state.missedAt = time.Time{}
+		return false
+	}
+
+	// Remind once per window while the job keeps missing it
+	if !state.missedAt.IsZero() && now.Sub(state.missedAt) < window {
+		return false
+	}
+
+	state.missedAt = now
+	return true
+}
+
+// restore sets the last run results from the history records, newest first
+func (r *stateRegistry) restore(name string, runs []*Run) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	state := r.fetch(name)
+	restored := false
+
+	for _, run := range runs {
+		// Skipped runs never change the job state
+		if run.result() == resultSkipped {
+			continue
+		}
+
+		if !restored {
+			state.LastStartedAt = run.StartedAt
+			state.LastDuration = run.Duration
+			state.LastExitStatus = run.ExitStatus
+			state.LastSuccess = run.Success
+			state.LastResult = run.result()
+			restored = true
+		}
+
+		if run.Success {
+			state.LastSuccessAt = run.FinishedAt
+			break
+		}
+
+		if failed(run.result()) {
+			if run.Attempt <= 1 {
+				state.ConsecutiveFailures++
+			}
+
+			// Restore the time of the last alert of the current failure streak
+			if state.alertedAt.IsZero() && run.notified() {
+				state.alertedAt = run.FinishedAt
+			}
+		}
+	}
+}
+
+// get returns a copy of the job state
+func (r *stateRegistry) get(name string) jobState {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if state := r.states[name]; state != nil {
+		result := *state
+		result.instances = nil
+		return result
+	}
+	return jobState{}
+}
+
+// String returns a short description of the job state
+func (s jobState) String() string {
+	running := "no"
+	if s.Running > 0 {
+		running = fmt.Sprintf("yes (%d)", s.Running)
+	}
+	if s.LastStartedAt.IsZero() {
+		return fmt.Sprintf("running: %s, last run: n/a", running)
+	}
+	if s.LastResult == "" {
+		return fmt.Sprintf("running: %s, last run: %s (in progress)", running, s.LastStartedAt.Format(time.RFC3339))
+	}
+
+	return fmt.Sprintf(
+		"running: %s, last run: %s (%s, exit status: %d, duration: %v)",
+		running,
+		s.LastStartedAt.Format(time.RFC3339),
+		s.LastResult,
+		s.LastExitStatus,
+		s.LastDuration,
+	)
+}
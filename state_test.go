@@ -0,0 +1,200 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAttempt returns the finished attempt from the "<result><attempt>"
+// token, e.g. "f1" for the failed first attempt or "s2" for the successful
+// retry
+func testAttempt(config *JobConfig, token string) *Job {
+	j := &Job{config: config, result: resultFailure}
+	if token[0] == 's' {
+		j.result = resultSuccess
+		j.success = true
+	}
+	j.attempt, _ = strconv.Atoi(token[1:])
+	return j
+}
+
+func TestStateAlert(t *testing.T) {
+	examples := []struct {
+		mode     string
+		after    int
+		realert  time.Duration
+		attempts string // Finished attempts in order
+		alerts   string // Alert decision for every attempt
+	}{
+		// Every failure is reported in error mode
+		{notifyError, 0, 0, "f1 f1 s1 f1", "1101"},
+		{notifyError, 3, 0, "f1 f1 f1 f1 s1 f1 f1", "0011000"},
+		{notifyError, 0, time.Hour, "f1 f1 f1 s1 f1", "10001"},
+		{notifyError, 0, time.Nanosecond, "f1 f1 f1", "111"},
+
+		// Change mode reports the first failure and the recovery
+		{notifyChange, 0, 0, "f1 f1 s1 f1 s1 s1", "101110"},
+		{notifyChange, 2, 0, "f1 s1 f1 f1 s1", "00011"},
+		{notifyChange, 0, time.Hour, "f1 f1 f1", "100"},
+		{notifyChange, 0, time.Nanosecond, "f1 f1 f1", "111"},
+
+		// All mode reports successes, failures respect the threshold
+		{notifyAll, 0, 0, "f1 s1 f1", "111"},
+		{notifyAll, 2, 0, "f1 f1 s1", "011"},
+		{notifyAll, 0, time.Hour, "f1 f1 s1 s1", "1011"},
+
+		// Failed attempts of the retried run count as one failure
+		{notifyError, 3, 0, "f1 f2 f3 f1 f2 f3 f1 f2 f3", "000000111"},
+		{notifyError, 2, 0, "f1 s2 f1 f2 f1", "00001"},
+		{notifyChange, 2, 0, "f1 f2 f1 f2 s1", "00101"},
+	}
+
+	for _, ex := range examples {
+		config := &JobConfig{
+			Name:   "backup",
+			Notify: &NotifyConfig{Mode: ex.mode, After: ex.after, Realert: ex.realert},
+		}
+		state := newStateRegistry()
+
+		alerts := ""
+		for _, token := range strings.Fields(ex.attempts) {
+			j := testAttempt(config, token)
+			state.update(j)
+
+			// Realert interval passes between the attempts
+			if ex.realert == time.Nanosecond {
+				time.Sleep(time.Millisecond)
+			}
+
+			if state.alert(j) {
+				alerts += "1"
+			} else {
+				alerts += "0"
+			}
+		}
+
+		if alerts != ex.alerts {
+			t.Errorf("on = %s, after = %d, realert = %v, attempts %q: alerts = %s, expected %s",
+				ex.mode, ex.after, ex.realert, ex.attempts, alerts, ex.alerts)
+		}
+	}
+}
+
+func TestStateRestore(t *testing.T) {
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	notified := []notifyResult{{Target: "slack", Success: true}}
+
+	// run returns the history record from the "<result><attempt>" token,
+	// "n" suffix means the failure was notified
+	run := func(i int, token string) *Run {
+		r := &Run{
+			ID:         int64(i),
+			StartedAt:  start.Add(time.Duration(i) * time.Hour),
+			FinishedAt: start.Add(time.Duration(i)*time.Hour + time.Minute),
+		}
+		if strings.HasSuffix(token, "n") {
+			r.Notifications = notified
+			token = strings.TrimSuffix(token, "n")
+		}
+		switch token[0] {
+		case 's':
+			r.Success = true
+			r.Result = resultSuccess
+		case 'f':
+			r.Result = resultFailure
+		case 't':
+			r.Result = resultTimeout
+		case 'k':
+			r.Result = resultSkipped
+		}
+		r.Attempt, _ = strconv.Atoi(token[1:])
+		return r
+	}
+
+	examples := []struct {
+		runs     string // History records, oldest first
+		failures int
+		result   string
+		success  int // Record of the last success, -1 if none
+		alerted  int // Record of the restored alert, -1 if none
+	}{
+		{"", 0, "", -1, -1},
+		{"s1", 0, resultSuccess, 0, -1},
+		{"f1 s1 f1 t1", 2, resultTimeout, 1, -1},
+		{"s1 f1 f2 f3 f1", 2, resultFailure, 0, -1},
+		{"f1 s2 f1 k1", 1, resultFailure, 1, -1},
+		{"f1 f1n f1 f1", 4, resultFailure, -1, 1},
+		{"f1n s1 f1", 1, resultFailure, 1, -1},
+
+		// Legacy records have no attempt number
+		{"f0 f0", 2, resultFailure, -1, -1},
+	}
+
+	for _, ex := range examples {
+		runs := []*Run{}
+		for i, token := range strings.Fields(ex.runs) {
+			runs = append([]*Run{run(i, token)}, runs...)
+		}
+
+		registry := newStateRegistry()
+		registry.restore("backup", runs)
+		state := registry.get("backup")
+
+		if state.ConsecutiveFailures != ex.failures {
+			t.Errorf("runs %q: consecutive failures = %d, expected %d", ex.runs, state.ConsecutiveFailures, ex.failures)
+		}
+		if state.LastResult != ex.result {
+			t.Errorf("runs %q: last result = %q, expected %q", ex.runs, state.LastResult, ex.result)
+		}
+
+		successAt := time.Time{}
+		if ex.success >= 0 {
+			successAt = run(ex.success, "s1").FinishedAt
+		}
+		if !state.LastSuccessAt.Equal(successAt) {
+			t.Errorf("runs %q: last success at %v, expected %v", ex.runs, state.LastSuccessAt, successAt)
+		}
+
+		alertedAt := time.Time{}
+		if ex.alerted >= 0 {
+			alertedAt = run(ex.alerted, "f1").FinishedAt
+		}
+		if !registry.states["backup"].alertedAt.Equal(alertedAt) {
+			t.Errorf("runs %q: alerted at %v, expected %v", ex.runs, registry.states["backup"].alertedAt, alertedAt)
+		}
+	}
+}
+
+func TestStateRestoreAlert(t *testing.T) {
+	config := &JobConfig{
+		Name:   "backup",
+		Notify: &NotifyConfig{Mode: notifyChange},
+	}
+
+	// Failure was reported before the restart
+	registry := newStateRegistry()
+	registry.restore(config.Name, []*Run{{
+		ID:            1,
+		Result:        resultFailure,
+		Attempt:       1,
+		FinishedAt:    time.Now(),
+		Notifications: []notifyResult{{Target: "slack", Success: true}},
+	}})
+
+	for _, ex := range []struct {
+		token string
+		alert bool
+	}{
+		{"f1", false},
+		{"s1", true},
+		{"f1", true},
+	} {
+		j := testAttempt(config, ex.token)
+		registry.update(j)
+		if alert := registry.alert(j); alert != ex.alert {
+			t.Fatalf("attempt %s after restart: alert = %v, expected %v", ex.token, alert, ex.alert)
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// Default number of runs to keep per job
+	defaultKeepRuns = 100
+
+	// Default directory of the history file
+	defaultHistoryPath = "/var/lib/cron2"
+
+	// Name of the file with run records
+	historyFile = "history.jsonl"
+
+	// Number of recent runs in the history summary
+	historySummaryRuns = 10
+)
+
+// Run represents a single job execution record
+type Run struct {
+	ID         int64         `json:"id"`
+	Job        string        `json:"job"`
+	Trigger    string        `json:"trigger"`
+	StartedAt  time.Time     `json:"started_at"`
+	FinishedAt time.Time     `json:"finished_at"`
+	Duration   time.Duration `json:"duration"`
+	Success    bool          `json:"success"`
+	Result     string        `json:"result"`
+	Attempt    int           `json:"attempt,omitempty"`
+	ExitStatus int           `json:"exit_status"`
+	Output     string        `json:"output,omitempty"`
+	OOMKilled  bool          `json:"oom_killed,omitempty"`
+
+	Notifications []notifyResult     `json:"notifications,omitempty"`
+	Lingering     []lingeringProcess `json:"lingering,omitempty"` // Processes left running by the command
+}
+
+// lingeringProcess represents a process that was still running after the
+// job command has exited
+type lingeringProcess struct {
+	PID     int    `json:"pid"`
+	Command string `json:"command"`
+	Killed  bool   `json:"killed"` // Killed according to the job policy
+}
+
+// historyStore keeps records of all job runs. Records are kept in memory and
+// appended to the history file, the file is compacted once removed records
+// outnumber the kept ones.
+type historyStore struct {
+	path        string
+	keepRuns    int
+	maxAge      time.Duration
+	lock        *sync.Mutex
+	lastID      int64
+	runs        map[string][]*Run
+	fileRecords int // Number of records in the history file
+}
+
+// newHistoryStore returns a new store and loads existing records from disk
+func newHistoryStore(config *HistoryConfig) (*historyStore, error) {
+	store := &historyStore{
+		keepRuns: defaultKeepRuns,
+		lock:     new(sync.Mutex),
+		runs:     map[string][]*Run{},
+	}
+
+	path := defaultHistoryPath
+	if config != nil {
+		if config.KeepRuns > 0 {
+			store.keepRuns = config.KeepRuns
+		}
+		store.maxAge = config.MaxAge
+		if config.Path != "" {
+			path = config.Path
+		}
+	}
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		if path != defaultHistoryPath {
+			return nil, err
+		}
+
+		// Job state is not restored on restart without the history file
+		log.Printf("cant create history directory, keeping history in memory: %v\n", err)
+		return store, nil
+	}
+	store.path = filepath.Join(path, historyFile)
+
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// load reads all existing run records from the history file
+func (s *historyStore) load() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		run := &Run{}
+		if err := json.Unmarshal(scanner.Bytes(), run); err != nil {
+			log.Printf("skipping invalid history record on line %d: %v\n", line, err)
+			continue
+		}
+		if run.ID > s.lastID {
+			s.lastID = run.ID
+		}
+		s.runs[run.Job] = append(s.runs[run.Job], run)
+		s.fileRecords++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	s.prune()
+	return s.compact()
+}
+
+// nextID returns a new unique run ID
+func (s *historyStore) nextID() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lastID++
+	return s.lastID
+}
+
+// add saves the run record and applies retention limits
+func (s *historyStore) add(run *Run) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.runs[run.Job] = append(s.runs[run.Job], run)
+
+	s.prune()
+	if s.path == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	data, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	s.fileRecords++
+
+	return s.compact()
+}
+
+// update replaces the saved record of the run
+func (s *historyStore) update(run *Run) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	runs := s.runs[run.Job]
+	for i := range runs {
+		if runs[i].ID != run.ID {
+			continue
+		}
+		runs[i] = run
+
+		// Records are rarely updated, the file is rewritten
+		if s.path == "" {
+			return nil
+		}
+		return s.save()
+	}
+	return nil
+}
+
+// compact rewrites the history file without removed records once they
+// outnumber the kept records, so the file is not rewritten on every run
+func (s *historyStore) compact() error {
+	kept := 0
+	for _, runs := range s.runs {
+		kept += len(runs)
+	}
+
+	removed := s.fileRecords - kept
+	if removed <= kept && removed < s.keepRuns {
+		return nil
+	}
+	return s.save()
+}
+
+// list returns up to limit most recent runs of the job, newest first
+func (s *historyStore) list(job string, limit int) []*Run {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	runs := s.runs[job]
+	if limit <= 0 || limit > len(runs) {
+		limit = len(runs)
+	}
+
+	result := make([]*Run, 0, limit)
+	for i := len(runs) - 1; i >= len(runs)-limit; i-- {
+		result = append(result, runs[i])
+	}
+	return result
+}
+
+// find returns the run with the given ID
+func (s *historyStore) find(id int64) *Run {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, runs := range s.runs {
+		for _, run := range runs {
+			if run.ID == id {
+				return run
+			}
+		}
+	}
+	return nil
+}
+
+// prune removes records outside of retention limits
+func (s *historyStore) prune() {
+	minTime := time.Now().Add(-s.maxAge)
+
+	for job, runs := range s.runs {
+		start := 0
+		if len(runs) > s.keepRuns {
+			start = len(runs) - s.keepRuns
+		}
+		if s.maxAge > 0 {
+			for start < len(runs) && runs[start].StartedAt.Before(minTime) {
+				start++
+			}
+		}
+		if start == 0 {
+			continue
+		}
+
+		if start == len(runs) {
+			delete(s.runs, job)
+		} else {
+			s.runs[job] = append([]*Run{}, runs[start:]...)
+		}
+	}
+}
+
+// save writes all records into the history file
+func (s *historyStore) save() error {
+	f, err := ioutil.TempFile(filepath.Dir(s.path), historyFile)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	for _, runs := range s.runs {
+		for _, run := range runs {
+			data, err := json.Marshal(run)
+			if err != nil {
+				f.Close()
+				return err
+			}
+			w.Write(data)
+			w.WriteByte('\n')
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(f.Name(), s.path); err != nil {
+		return err
+	}
+
+	s.fileRecords = 0
+	for _, runs := range s.runs {
+		s.fileRecords += len(runs)
+	}
+	return nil
+}
+
+// historySummary represents results of the recent runs of the job
+type historySummary struct {
+	Runs                int       // Number of recent runs
+	Successes           int       // Number of successful runs
+	Failures            int       // Number of failed runs
+	ConsecutiveFailures int       // Number of failed runs since the last success
+	LastSuccessAt       time.Time // Finish time of the last successful run
+	Recent              []*Run    // Recent runs, newest first
+}
+
+// summarizeRuns returns the summary of the runs, newest first. Skipped runs
+// are not counted.
+func summarizeRuns(runs []*Run) *historySummary {
+	summary := &historySummary{Recent: runs}
+	streak := true
+
+	for _, run := range runs {
+		if run.result() == resultSkipped {
+			continue
+		}
+		summary.Runs++
+
+		if run.Success {
+			summary.Successes++
+			streak = false
+			if summary.LastSuccessAt.IsZero() {
+				summary.LastSuccessAt = run.FinishedAt
+			}
+			continue
+		}
+
+		summary.Failures++
+		if streak {
+			summary.ConsecutiveFailures++
+		}
+	}
+
+	return summary
+}
+
+// result returns the outcome of the run
+func (r *Run) result() string {
+	if r.Result != "" {
+		return r.Result
+	}
+	if r.Success {
+		return resultSuccess
+	}
+	return resultFailure
+}
+
+// notified returns true if any of the run notifications was delivered
+func (r *Run) notified() bool {
+	for _, n := range r.Notifications {
+		if n.Success {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns a short description of the run
+func (r *Run) String() string {
+	line := fmt.Sprintf(
+		"#%d %s [%s] %s, exit status: %d, duration: %v",
+		r.ID,
+		r.StartedAt.Format(time.RFC3339),
+		r.Trigger,
+		r.result(),
+		r.ExitStatus,
+		r.Duration,
+	)
+	if r.Attempt > 1 {
+		line += fmt.Sprintf(", attempt: %d", r.Attempt)
+	}
+	if r.Output != "" {
+		line += ", output: " + r.Output
+	}
+	if r.OOMKilled {
+		line += ", out of memory"
+	}
+	if len(r.Lingering) > 0 {
+		line += fmt.Sprintf(", lingering processes: %d", len(r.Lingering))
+		if r.Lingering[0].Killed {
+			line += " (killed)"
+		}
+	}
+	if len(r.Notifications) > 0 {
+		sent := 0
+		for _, n := range r.Notifications {
+			if n.Success {
+				sent++
+			}
+		}
+		line += fmt.Sprintf(", notified: %d/%d", sent, len(r.Notifications))
+	}
+	return line
+}
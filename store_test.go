@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestHistoryStore opens the store in the directory
+func newTestHistoryStore(t *testing.T, config *HistoryConfig) *historyStore {
+	store, err := newHistoryStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// addTestRun saves the run of the job started at the given time
+func addTestRun(t *testing.T, store *historyStore, job string, startedAt time.Time) int64 {
+	run := &Run{
+		ID:        store.nextID(),
+		Job:       job,
+		StartedAt: startedAt,
+		Success:   true,
+		Result:    resultSuccess,
+	}
+	if err := store.add(run); err != nil {
+		t.Fatal(err)
+	}
+	return run.ID
+}
+
+// runIDs returns IDs of the job runs, newest first
+func runIDs(store *historyStore, job string) []int64 {
+	ids := []int64{}
+	for _, run := range store.list(job, 0) {
+		ids = append(ids, run.ID)
+	}
+	return ids
+}
+
+// countLines returns the number of lines in the file
+func countLines(t *testing.T, path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines++
+	}
+	return lines
+}
+
+// equalIDs returns true if both lists have the same IDs in the same order
+func equalIDs(a []int64, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestHistoryStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cron2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := &HistoryConfig{Path: dir, KeepRuns: 3}
+	store := newTestHistoryStore(t, config)
+	path := filepath.Join(dir, historyFile)
+
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		addTestRun(t, store, "backup", now)
+
+		// File is compacted once removed records outnumber the kept ones
+		if lines := countLines(t, path); lines > 5 {
+			t.Fatalf("history file has %d lines after %d runs", lines, i+1)
+		}
+	}
+	addTestRun(t, store, "report", now)
+
+	if ids := runIDs(store, "backup"); !equalIDs(ids, []int64{10, 9, 8}) {
+		t.Fatalf("backup runs = %v", ids)
+	}
+	if ids := runIDs(store, "backup"); len(store.list("backup", 2)) != 2 || ids[0] != 10 {
+		t.Fatalf("limited list of backup runs = %v", ids)
+	}
+
+	// Reopened store has the same records and continues run IDs
+	store = newTestHistoryStore(t, config)
+
+	if ids := runIDs(store, "backup"); !equalIDs(ids, []int64{10, 9, 8}) {
+		t.Errorf("backup runs after reopen = %v", ids)
+	}
+	if ids := runIDs(store, "report"); !equalIDs(ids, []int64{11}) {
+		t.Errorf("report runs after reopen = %v", ids)
+	}
+	if run := store.find(9); run == nil || run.Job != "backup" {
+		t.Errorf("run #9 = %v", run)
+	}
+	if id := store.nextID(); id != 12 {
+		t.Errorf("next id = %d, expected 12", id)
+	}
+}
+
+func TestHistoryStoreMaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cron2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := newTestHistoryStore(t, &HistoryConfig{Path: dir})
+
+	now := time.Now()
+	addTestRun(t, store, "backup", now.Add(-3*time.Hour))
+	addTestRun(t, store, "backup", now.Add(-90*time.Minute))
+	addTestRun(t, store, "backup", now)
+	addTestRun(t, store, "report", now.Add(-2*time.Hour))
+
+	// Records older than max age are pruned when the store is opened
+	store = newTestHistoryStore(t, &HistoryConfig{Path: dir, MaxAge: time.Hour})
+
+	if ids := runIDs(store, "backup"); !equalIDs(ids, []int64{3}) {
+		t.Errorf("backup runs = %v", ids)
+	}
+	if ids := runIDs(store, "report"); len(ids) != 0 {
+		t.Errorf("report runs = %v", ids)
+	}
+	if id := store.nextID(); id != 5 {
+		t.Errorf("next id = %d, expected 5", id)
+	}
+}
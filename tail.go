@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"sync"
+)
+
+const (
+	// Max number of output bytes kept for notifications
+	tailBufferSize = 64 * 1024
+
+	// Default number of output lines included into notifications
+	defaultOutputLines = 20
+
+	// Replacement text for redacted output
+	redactedText = "[REDACTED]"
+)
+
+// tailBuffer keeps the last bytes written into it
+type tailBuffer struct {
+	lock *sync.Mutex
+	data []byte
+	size int
+}
+
+func newTailBuffer(size int) *tailBuffer {
+	return &tailBuffer{
+		lock: new(sync.Mutex),
+		size: size,
+	}
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.data = append(t.data, p...)
+	if extra := len(t.data) - t.size; extra > 0 {
+		t.data = append(t.data[:0], t.data[extra:]...)
+	}
+	return len(p), nil
+}
+
+// tail returns up to the given number of last lines, limited to max bytes.
+// Zero values mean no limit.
+func (t *tailBuffer) tail(lines int, maxBytes int) string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	data := bytes.TrimRight(t.data, "\n")
+	if lines > 0 {
+		start := len(data)
+		for i := 0; i < lines && start > 0; i++ {
+			start = bytes.LastIndexByte(data[:start], '\n')
+			if start < 0 {
+				start = 0
+			}
+		}
+		if start > 0 {
+			start++ // Skip the line break
+		}
+		data = data[start:]
+	}
+	if maxBytes > 0 && len(data) > maxBytes {
+		data = data[len(data)-maxBytes:]
+	}
+
+	return string(data)
+}
+
+// redact replaces all matches of the patterns with a placeholder
+func redact(text string, patterns []*regexp.Regexp) string {
+	for _, re := range patterns {
+		text = re.ReplaceAllString(text, redactedText)
+	}
+	return text
+}
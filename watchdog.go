@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// How often the watchdog checks jobs for missed success windows
+const watchdogInterval = time.Minute
+
+// watch periodically checks that jobs with the expect_success_within setting
+// have succeeded in time, until the service is stopped. Jobs are checked
+// against the config, so disabled jobs and jobs that failed to be scheduled
+// are caught too.
+func (s *Service) watch() {
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+
+	for {
+		s.checkDeadlines(time.Now())
+
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// checkDeadlines sends notifications for jobs that missed the success window
+func (s *Service) checkDeadlines(now time.Time) {
+	s.configLock.Lock()
+	jobs := []*JobConfig{}
+	scheduled := map[string]bool{}
+	for _, config := range s.config.Jobs {
+		if config.ExpectSuccessWithin > 0 {
+			jobs = append(jobs, config)
+			scheduled[config.Name] = config.ID > 0
+		}
+	}
+	s.configLock.Unlock()
+
+	for _, config := range jobs {
+		if !s.state.missed(config, now) {
+			continue
+		}
+
+		log.Printf(
+			"[%s] no successful runs within %v, scheduled: %v\n",
+			config.Name,
+			config.ExpectSuccessWithin,
+			scheduled[config.Name],
+		)
+
+		job := &Job{
+			config:    config,
+			service:   s,
+			trigger:   triggerWatchdog,
+			startedAt: now,
+			result:    resultMissed,
+		}
+		if !s.begin() {
+			return
+		}
+		go func() {
+			defer s.end()
+			sendNotifications(job)
+		}()
+	}
+}